@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync_files/internal/stream"
+)
+
+// Подтверждение продолжения приостановленной синхронизации:
+// <программа> confirm <директория>...
+func runConfirm(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: confirm <directory>...")
+	}
+	for _, path := range args {
+		fsys, root, err := rootFS(path)
+		if err != nil {
+			log.Fatal("Directory: {", path, "} Error: ", err)
+		}
+		if err := stream.Confirm(fsys, root); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Synchronisation is confirmed:", path)
+	}
+}
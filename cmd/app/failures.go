@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync_files/internal/config"
+	"sync_files/internal/stream"
+	"time"
+)
+
+// Просмотр и сброс ошибок операций с файлами:
+// <программа> failures [-state файл | -config файл | <директория>...] [-json]
+// <программа> failures -clear <директория> [файл...]
+func runFailures(args []string) {
+	flags := flag.NewFlagSet("failures", flag.ExitOnError)
+	state := flags.String("state", "", "state file to read failures from, by default the state of the directories")
+	configFile := flags.String("config", "", "configuration file with state files of groups")
+	asJSON := flags.Bool("json", false, "print failures in JSON")
+	clear := flags.Bool("clear", false, "clear failures of the directory, all or only of the given files")
+	flags.Parse(args)
+
+	if *clear {
+		if flags.NArg() == 0 {
+			log.Fatal("Usage: failures -clear <directory> [file...]")
+		}
+		path := flags.Arg(0)
+		fsys, root, err := rootFS(path)
+		if err != nil {
+			log.Fatal("Directory: {", path, "} Error: ", err)
+		}
+		if err := stream.ClearFailures(fsys, root, flags.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Failures are cleared:", path)
+		return
+	}
+
+	states := []string{*state}
+	if *state == "" && *configFile == "" {
+		if flags.NArg() == 0 {
+			log.Fatal("Usage: failures [-state file | -config file | <directory>...] [-json]")
+		}
+		var dirs []string
+		for _, dir := range flags.Args() {
+			path, err := resolveDir(dir)
+			if err != nil {
+				log.Fatal("Directory: {", dir, "} Error: ", err)
+			}
+			dirs = append(dirs, path)
+		}
+		base, err := stateBase(dirs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		states[0] = base + ".json"
+	}
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		states = states[:0]
+		for _, group := range cfg.Groups {
+			states = append(states, group.State)
+		}
+	}
+
+	var list []stream.Failure
+	for _, fileName := range states {
+		failures, err := stream.LoadFailures(fileName)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		list = append(list, failures...)
+	}
+
+	if *asJSON {
+		if list == nil {
+			list = []stream.Failure{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printFailures(os.Stdout, list)
+}
+
+// Вывод ошибок в читаемом виде
+func printFailures(w io.Writer, list []stream.Failure) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "No failures")
+		return
+	}
+	for _, failure := range list {
+		status := "retry at " + failure.Next.Format(time.DateTime)
+		if failure.Quarantined {
+			status = "quarantined"
+		}
+		fmt.Fprintf(w, "%s: %s\n", failure.Path, failure.Name)
+		fmt.Fprintf(w, "  %s failed %d times, %s: %s\n",
+			failure.Op, failure.Attempts, status, failure.Err)
+	}
+}
@@ -2,17 +2,67 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync_files/internal/config"
 	"sync_files/internal/logs"
 	"sync_files/internal/stream"
 	"syscall"
+	"time"
 )
 
+// Период сохранения состояния буфера
+const statePeriod = 30 * time.Second
+
+// Получение абсолютного пути локальной директории без символических ссылок.
+// Адрес удалённой директории приводится к единому виду
+func resolveDir(dir string) (string, error) {
+	if stream.IsPeer(dir) {
+		_, _, path, err := stream.ParsePeer(dir)
+		return path, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// Путь без расширения к файлам состояния и лога набора директорий по умолчанию.
+// Имя файла зависит только от набора директорий, поэтому процессы,
+// синхронизирующие разные директории, не используют общие файлы
+func stateBase(dirs []string) (string, error) {
+	root := os.Getenv("XDG_STATE_HOME")
+	if root == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		root = filepath.Join(home, ".local", "state")
+	}
+	root = filepath.Join(root, "sync_files")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+
+	sorted := slices.Clone(dirs)
+	slices.Sort(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\x00")))
+	return filepath.Join(root, "sync-"+hex.EncodeToString(sum[:8])), nil
+}
+
 // Проверка наличия диектории
 func CheckFile(fName string) error {
 	_, err := os.Stat(fName)
@@ -22,9 +72,22 @@ func CheckFile(fName string) error {
 	return nil
 }
 
+// Получение файловой системы локальной или удалённой директории
+// и пути директории в ней с проверкой, что директория существует
+func rootFS(dir string) (stream.FS, string, error) {
+	fsys, paths, err := stream.RootsFS([]string{dir}, os.Getenv(peerTokenEnv))
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fsys.Stat(paths[0]); err != nil {
+		return nil, "", err
+	}
+	return fsys, paths[0], nil
+}
+
 // Проверка введённого числа на корректность
-func CheckNum() (int, error) {
-	strNum := os.Args[1]
+func CheckNum(args []string) (int, error) {
+	strNum := args[0]
 	num, err := strconv.Atoi(strNum)
 	if err != nil {
 		return 0, err
@@ -36,48 +99,356 @@ func CheckNum() (int, error) {
 }
 
 // Проверка путей к директориям и возвращение числа из аргументак командной строки
-func CheckArgs() int {
-	if len(os.Args) < 4 {
+func CheckArgs(args []string) int {
+	if len(args) < 3 {
 		log.Fatal("Not enough arguments")
 	}
 
-	num, err := CheckNum()
+	num, err := CheckNum(args)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for i := 2; i < len(os.Args); i++ {
-		if err := CheckFile(os.Args[i]); err != nil {
-			log.Fatal("Directory: {", os.Args[i],
+	for i := 1; i < len(args); i++ {
+		// Удалённые директории проверяются при подключении
+		if stream.IsPeer(args[i]) {
+			continue
+		}
+		if err := CheckFile(args[i]); err != nil {
+			log.Fatal("Directory: {", args[i],
 				"} Error: ", err)
 		}
 	}
+	// Совпадающие или вложенные директории копировались бы сами в себя
+	if err := stream.CheckRoots(args[1:]); err != nil {
+		log.Fatal(err)
+	}
 	return num
 }
 
-func main() {
-	timeMult := CheckArgs()
+// Флаг, который можно указать несколько раз
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Группа директорий, синхронизируемых общим буфером
+type syncGroup struct {
+	Name     string
+	Dirs     []string
+	Interval int
+	State    string
+	Opts     stream.Options
+}
 
-	logs.LogsInit()
+// Получение группы директорий и файла лога из флагов и аргументов командной строки.
+// Файлы состояния и лога по умолчанию определяются набором директорий
+func groupFromArgs(args []string, opts stream.Options, conflict, links string) (syncGroup, string) {
+	timeMult := CheckArgs(args)
+	paths := make([]string, 0, len(args)-1)
+	for _, dir := range args[1:] {
+		path, err := resolveDir(dir)
+		if err != nil {
+			log.Fatal("Directory: {", dir, "} Error: ", err)
+		}
+		paths = append(paths, path)
+	}
+	base, err := stateBase(paths)
+	if err != nil {
+		log.Fatal("Can't create state directory: ", err)
+	}
+
+	policy, err := stream.ParseConflictPolicy(conflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.PreferDir != "" {
+		if prefer, err := resolveDir(opts.PreferDir); err == nil {
+			opts.PreferDir = prefer
+		}
+	}
+	if policy == stream.ConflictPrefer && !slices.Contains(paths, opts.PreferDir) {
+		log.Fatal("Directory from -prefer is not synchronised: ", opts.PreferDir)
+	}
+	opts.Conflict = policy
+
+	opts.Links, err = stream.ParseLinkMode(links)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.KeepVersions < 0 || opts.KeepDays < 0 {
+		log.Fatal("Versions retention can't be negative")
+	}
+	if opts.MaxDelete < 0 || opts.MaxDeletePercent < 0 || opts.MaxDeletePercent > 100 {
+		log.Fatal("Mass deletion limits are not correct")
+	}
+	if opts.MaxAttempts < 0 {
+		log.Fatal("Number of attempts can't be negative")
+	}
+	if opts.Settle < 0 {
+		log.Fatal("Settle time can't be negative")
+	}
+
+	return syncGroup{
+		Dirs:     paths,
+		Interval: timeMult,
+		State:    base + ".json",
+		Opts:     opts,
+	}, base + ".log"
+}
 
-	//Создание буфера, хранящего информацию о файлах из заданных директорий
-	buf, err := stream.SyncInfo(os.Args[2:])
+// Получение групп директорий и файла лога из файла конфигурации
+func groupsFromConfig(fileName string) ([]syncGroup, string) {
+	cfg, err := config.Load(fileName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var groups []syncGroup
+	for i, group := range cfg.Groups {
+		opts, err := cfg.Options(i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		groups = append(groups, syncGroup{
+			Name:     group.Name,
+			Dirs:     group.Dirs,
+			Interval: group.Interval,
+			State:    group.State,
+			Opts:     opts,
+		})
+	}
+	if cfg.Log != "" {
+		return groups, cfg.Log
+	}
+
+	// Лог по умолчанию определяется всеми директориями файла конфигурации
+	var dirs []string
+	for _, group := range cfg.Groups {
+		for _, dir := range group.Dirs {
+			path, err := resolveDir(dir)
+			if err != nil {
+				log.Fatal("Directory: {", dir, "} Error: ", err)
+			}
+			dirs = append(dirs, path)
+		}
+	}
+	base, err := stateBase(dirs)
+	if err != nil {
+		log.Fatal("Can't create state directory: ", err)
+	}
+	return groups, base + ".log"
+}
+
+// Подключение удалённых директорий группы
+func (group *syncGroup) mountPeers() {
+	fsys, paths, err := stream.RootsFS(group.Dirs, os.Getenv(peerTokenEnv))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stream.IsPeer(group.Opts.PreferDir) {
+		_, _, group.Opts.PreferDir, err = stream.ParsePeer(group.Opts.PreferDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	group.Dirs = paths
+	group.Opts.FS = fsys
+}
+
+// Блокировка локальных директорий группы, чтобы их не синхронизировал
+// другой запущенный процесс. Удалённые директории блокирует сервер
+func (group *syncGroup) lockDirs() []*stream.RootLock {
+	var locks []*stream.RootLock
+	for _, dir := range group.Dirs {
+		if stream.IsPeer(dir) {
+			continue
+		}
+		lock, err := stream.LockRoot(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+// Снятие блокировок директорий
+func unlockDirs(locks []*stream.RootLock) {
+	for _, lock := range locks {
+		if err := lock.Unlock(); err != nil {
+			fmt.Println("Can't unlock directory:", err)
+		}
+	}
+}
+
+// Удаление временных файлов и загрузка сохранённого состояния
+// или создание буфера, хранящего информацию о файлах из директорий группы
+func (group *syncGroup) loadBuf() *stream.BufInfo {
+	for _, dir := range group.Dirs {
+		if stream.IsPeer(dir) {
+			continue
+		}
+		if err := stream.CleanTemp(group.Opts.FS, dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return group.readBuf()
+}
+
+// Загрузка сохранённого состояния или создание буфера без изменения директорий
+func (group *syncGroup) readBuf() *stream.BufInfo {
+	buf, err := stream.LoadState(group.State, group.Dirs, group.Opts)
+	if errors.Is(err, fs.ErrNotExist) {
+		buf, err = stream.SyncInfo(group.Dirs, group.Opts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return buf
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "confirm" {
+		runConfirm(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "failures" {
+		runFailures(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
+		return
+	}
+	args := os.Args[1:]
+	var dryRun, once bool
+	if len(args) > 0 && args[0] == "plan" {
+		dryRun = true
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "once" {
+		once = true
+		args = args[1:]
+	}
+
+	var opts stream.Options
+	configFile := flag.String("config", "",
+		"configuration file with synchronisation groups")
+	flag.BoolVar(&opts.Hash, "hash", false,
+		"compare files by content hash, not only by time and size")
+	conflict := flag.String("conflict", string(stream.ConflictNewest),
+		"conflict policy: newest, keep-both or prefer")
+	flag.StringVar(&opts.PreferDir, "prefer", "",
+		"directory that wins conflicts with -conflict prefer")
+	flag.BoolVar(&opts.Poll, "poll", false,
+		"check directories with interval instead of inotify")
+	links := flag.String("links", string(stream.LinkPreserve),
+		"symbolic links mode: preserve, follow or skip")
+	flag.BoolVar(&opts.Versions, "versions", false,
+		"move deleted and overwritten files to "+stream.VersionsDir)
+	flag.IntVar(&opts.KeepVersions, "keep-versions", 0,
+		"number of versions to keep for each file, 0 - unlimited")
+	flag.IntVar(&opts.KeepDays, "keep-days", 0,
+		"number of days to keep versions, 0 - unlimited")
+	flag.BoolVar(&opts.Owner, "owner", false,
+		"preserve owner and group of files")
+	flag.BoolVar(&opts.Xattrs, "xattrs", false,
+		"preserve user, security and trusted extended attributes")
+	flag.BoolVar(&opts.ACLs, "acls", false,
+		"preserve POSIX ACLs")
+	flag.IntVar(&opts.MaxDelete, "max-delete", 0,
+		"pause synchronisation if more files are deleted in one cycle, 0 - unlimited")
+	flag.Float64Var(&opts.MaxDeletePercent, "max-delete-percent", stream.DefaultMaxDeletePercent,
+		"pause synchronisation if more percent of files are deleted in one cycle, 0 - unlimited")
+	flag.BoolVar(&opts.AllowMassDelete, "allow-mass-delete", false,
+		"don't pause synchronisation on mass deletion")
+	flag.IntVar(&opts.MaxAttempts, "max-attempts", stream.DefaultMaxAttempts,
+		"quarantine a file after this many failed attempts in a row, 0 - unlimited")
+	settle := flag.Int("settle", int(stream.DefaultSettle/time.Millisecond),
+		"copy a file only after its size and time didn't change for this many milliseconds, 0 - at once")
+	flag.Var((*listFlag)(&opts.Ignore), "ignore",
+		"ignore pattern in .gitignore format, can be repeated")
+	flag.BoolVar(&dryRun, "dry-run", dryRun,
+		"print what would be changed in each directory without changing files")
+	asJSON := flag.Bool("json", false,
+		"print the plan of -dry-run or plan in JSON")
+	flag.BoolVar(&once, "once", once,
+		"synchronise all directories once, print a summary and exit")
+	flag.CommandLine.Parse(args)
+	opts.Settle = time.Duration(*settle) * time.Millisecond
+
+	var (
+		groups  []syncGroup
+		logFile string
+	)
+	if *configFile != "" {
+		if flag.NArg() > 0 {
+			log.Fatal("Arguments can't be used together with -config")
+		}
+		groups, logFile = groupsFromConfig(*configFile)
+	} else {
+		var group syncGroup
+		group, logFile = groupFromArgs(flag.Args(), opts, *conflict, *links)
+		groups = []syncGroup{group}
+	}
+
+	if dryRun {
+		runPlan(groups, *asJSON)
+		return
+	}
+	if once {
+		os.Exit(runOnce(groups, logFile))
+	}
+
+	// Директории блокируются до открытия лога, чтобы не затереть
+	// лог уже запущенного процесса с теми же директориями.
+	// Лог по умолчанию у каждого набора директорий свой
+	var locks []*stream.RootLock
+	for i := range groups {
+		groups[i].mountPeers()
+		locks = append(locks, groups[i].lockDirs()...)
+	}
+
+	logs.LogsInit(logFile)
+
+	bufs := make([]*stream.BufInfo, len(groups))
+	for i := range groups {
+		bufs[i] = groups[i].loadBuf()
+	}
+
 	sigShut, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	var wg sync.WaitGroup
 
-	//Запуск горутин, синхронизирующих директории с буфером
-	for _, file := range os.Args[2:] {
+	for i, group := range groups {
+		buf := bufs[i]
+
+		//Запуск горутин, синхронизирующих директории с буфером.
+		//Недоступная директория не останавливает синхронизацию остальных
+		for _, file := range group.Dirs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf.RunSync(file, group.Interval, sigShut)
+			}()
+		}
+
+		//Периодическое сохранение состояния буфера
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			buf.RunSync(file, timeMult, sigShut)
-			cancel()
+			buf.RunSaveState(group.State, statePeriod, sigShut)
 		}()
 	}
 
@@ -90,5 +461,12 @@ func main() {
 
 	wg.Wait()
 
+	for i, group := range groups {
+		if err := bufs[i].SaveState(group.State); err != nil {
+			fmt.Println("Can't save state:", err)
+		}
+	}
+	unlockDirs(locks)
+
 	fmt.Println("Sinchronisation is over")
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync_files/internal/logs"
+	"sync_files/internal/stream"
+	"syscall"
+)
+
+// Коды завершения однократной синхронизации
+const (
+	exitOK = 0
+	// Синхронизация прервана, не удалась целиком или не закончилась,
+	// потому что файлы продолжают меняться
+	exitFailed = 1
+	// Были конфликты или ошибки с отдельными файлами
+	exitFileErrors = 2
+	// Директория недоступна или её синхронизация приостановлена
+	exitUnavailable = 3
+)
+
+// Однократная синхронизация групп для запуска из cron или CI:
+// <программа> once [флаги] <частота синх.> <директория 1> ... или -once.
+// Возвращает код завершения
+func runOnce(groups []syncGroup, logFile string) int {
+	var locks []*stream.RootLock
+	for i := range groups {
+		groups[i].mountPeers()
+		locks = append(locks, groups[i].lockDirs()...)
+	}
+	defer unlockDirs(locks)
+	logs.LogsInit(logFile)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var total stream.Stats
+	unavailable := make(map[string]string)
+	code := exitOK
+	for i := range groups {
+		buf := groups[i].loadBuf()
+		err := buf.SyncOnce(groups[i].Dirs, ctx)
+		if saveErr := buf.SaveState(groups[i].State); saveErr != nil {
+			fmt.Println("Can't save state:", saveErr)
+			code = exitFailed
+		}
+		if errors.Is(err, stream.ErrNotSettled) {
+			fmt.Println("Synchronisation is not finished:", err)
+			code = exitFailed
+		} else if err != nil {
+			fmt.Println("Synchronisation is interrupted:", err)
+			code = exitFailed
+		}
+
+		stats := buf.Stats()
+		total.Copied += stats.Copied
+		total.Bytes += stats.Bytes
+		total.Deleted += stats.Deleted
+		total.Moved += stats.Moved
+		total.Meta += stats.Meta
+		total.Conflicts += stats.Conflicts
+		total.Errors += stats.Errors
+		for _, dir := range groups[i].Dirs {
+			reason := buf.Paused(dir)
+			if reason != "" && buf.NeedConfirm(dir) {
+				reason += ", confirmation is needed"
+			}
+			if reason != "" {
+				unavailable[dir] = reason
+			}
+		}
+	}
+
+	printSummary(os.Stdout, total, unavailable)
+	switch {
+	case code != exitOK:
+		return code
+	case len(unavailable) > 0:
+		return exitUnavailable
+	case total.Conflicts > 0 || total.Errors > 0:
+		return exitFileErrors
+	}
+	return exitOK
+}
+
+// Вывод итогов синхронизации
+func printSummary(w io.Writer, stats stream.Stats, unavailable map[string]string) {
+	fmt.Fprintf(w, "Copied: %d\n", stats.Copied)
+	fmt.Fprintf(w, "Bytes: %d\n", stats.Bytes)
+	fmt.Fprintf(w, "Deleted: %d\n", stats.Deleted)
+	fmt.Fprintf(w, "Moved: %d\n", stats.Moved)
+	fmt.Fprintf(w, "Metadata: %d\n", stats.Meta)
+	fmt.Fprintf(w, "Conflicts: %d\n", stats.Conflicts)
+	fmt.Fprintf(w, "Errors: %d\n", stats.Errors)
+	for dir, reason := range unavailable {
+		fmt.Fprintf(w, "Unavailable: %s (%s)\n", dir, reason)
+	}
+}
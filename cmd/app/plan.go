@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync_files/internal/stream"
+	"syscall"
+)
+
+// План синхронизации группы директорий
+type groupPlan struct {
+	Group string            `json:"group,omitempty"`
+	Roots []stream.RootPlan `json:"roots"`
+}
+
+// Вывод плана синхронизации групп без изменения файлов и состояния:
+// <программа> plan [флаги] <частота синх.> <директория 1> ... или -dry-run
+func runPlan(groups []syncGroup, asJSON bool) {
+	// Лог не пишется, чтобы план не выглядел как выполненная синхронизация
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	plans := make([]groupPlan, 0, len(groups))
+	for i := range groups {
+		groups[i].mountPeers()
+		buf := groups[i].readBuf()
+		roots, err := buf.Plan(groups[i].Dirs, ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plans = append(plans, groupPlan{Group: groups[i].Name, Roots: roots})
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plans); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printPlan(os.Stdout, plans)
+}
+
+// Вывод плана в читаемом виде
+func printPlan(w io.Writer, plans []groupPlan) {
+	for _, plan := range plans {
+		if plan.Group != "" {
+			fmt.Fprintf(w, "Group %s\n", plan.Group)
+		}
+		for _, root := range plan.Roots {
+			fmt.Fprintf(w, "%s:\n", root.Path)
+			if root.Paused != "" && root.NeedConfirm {
+				fmt.Fprintf(w, "  paused: %s, confirmation is needed\n", root.Paused)
+			} else if root.Paused != "" {
+				fmt.Fprintf(w, "  paused: %s\n", root.Paused)
+			}
+			if len(root.Actions) == 0 && root.Paused == "" {
+				fmt.Fprintln(w, "  no changes")
+			}
+			for _, action := range root.Actions {
+				if action.To != "" {
+					fmt.Fprintf(w, "  %-9s %s -> %s\n", action.Op, action.Name, action.To)
+					continue
+				}
+				fmt.Fprintf(w, "  %-9s %s\n", action.Op, action.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync_files/internal/stream"
+)
+
+// Восстановление файла из директории версий:
+// <программа> restore [-list] [-version метка] <директория> <файл>
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	list := flags.Bool("list", false, "list saved versions of the file")
+	stamp := flags.String("version", "", "version to restore, the latest by default")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		log.Fatal("Usage: restore [-list] [-version stamp] <directory> <file>")
+	}
+	path, name := flags.Arg(0), flags.Arg(1)
+	if err := CheckFile(path); err != nil {
+		log.Fatal("Directory: {", path, "} Error: ", err)
+	}
+
+	if *list {
+		vers, err := stream.ListVersions(stream.LocalFS{}, path, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(vers) == 0 {
+			fmt.Println("No versions of", name)
+		}
+		for _, ver := range vers {
+			fmt.Printf("%s\t%d\n", ver.Stamp(), ver.Size)
+		}
+		return
+	}
+
+	ver, err := stream.RestoreVersion(stream.LocalFS{}, path, name, *stamp, context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Restored", name, "version", ver.Stamp())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync_files/internal/config"
+	"sync_files/internal/logs"
+	"sync_files/internal/stream"
+	"syscall"
+)
+
+// Переменная окружения с общим ключом сервера и клиентов удалённых директорий
+const peerTokenEnv = "SYNC_PEER_TOKEN"
+
+// Обслуживание директорий для синхронизации по сети:
+// <программа> serve [-listen адрес] <имя>=<директория>...
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "address to listen on")
+	logFile := flags.String("log", config.DefaultLog, "log file")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("Usage: serve [-listen address] <name>=<directory>...")
+	}
+	token := os.Getenv(peerTokenEnv)
+	if token == "" {
+		log.Fatal("Peer token must be set in ", peerTokenEnv)
+	}
+	roots := make(map[string]string)
+	var dirs []string
+	for _, arg := range flags.Args() {
+		name, dir, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || strings.Contains(name, "/") {
+			log.Fatal("Directory must be set as <name>=<directory>: ", arg)
+		}
+		if _, ok := roots[name]; ok {
+			log.Fatal("Directory name is already used: ", name)
+		}
+		if err := CheckFile(dir); err != nil {
+			log.Fatal("Directory: {", dir, "} Error: ", err)
+		}
+		roots[name] = dir
+		dirs = append(dirs, dir)
+	}
+	if err := stream.CheckRoots(dirs); err != nil {
+		log.Fatal(err)
+	}
+
+	// Обслуживаемую директорию не должен синхронизировать другой процесс
+	var locks []*stream.RootLock
+	for _, dir := range dirs {
+		lock, err := stream.LockRoot(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		locks = append(locks, lock)
+		if err := stream.CleanTemp(stream.LocalFS{}, dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	logs.LogsInit(*logFile)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigShut, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	fmt.Println("Serving on", ln.Addr())
+	if err := stream.Serve(ln, stream.LocalFS{}, roots, token, sigShut); err != nil {
+		log.Fatal(err)
+	}
+	unlockDirs(locks)
+	fmt.Println("Serving is over")
+}
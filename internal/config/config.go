@@ -0,0 +1,426 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync_files/internal/stream"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Файл лога по умолчанию
+const DefaultLog = "log.txt"
+
+// Настройки программы из файла конфигурации
+type Config struct {
+	// Файл лога
+	Log string `yaml:"log"`
+	// Интервал синхронизации по умолчанию в миллисекундах
+	Interval int `yaml:"interval"`
+	// Настройки синхронизации по умолчанию
+	Hash     bool   `yaml:"hash"`
+	Poll     bool   `yaml:"poll"`
+	Conflict string `yaml:"conflict"`
+	Prefer   string `yaml:"prefer"`
+	Links    string `yaml:"links"`
+	// Хранение удалённых и перезаписанных версий файлов
+	Versions     bool `yaml:"versions"`
+	KeepVersions int  `yaml:"keep_versions"`
+	KeepDays     int  `yaml:"keep_days"`
+	// Сохранение владельца, расширенных атрибутов и POSIX ACL
+	Owner  bool `yaml:"owner"`
+	Xattrs bool `yaml:"xattrs"`
+	ACLs   bool `yaml:"acls"`
+	// Защита от массового удаления, по умолчанию stream.DefaultMaxDeletePercent
+	MaxDelete        int      `yaml:"max_delete"`
+	MaxDeletePercent *float64 `yaml:"max_delete_percent"`
+	AllowMassDelete  bool     `yaml:"allow_mass_delete"`
+	// Количество неудачных попыток до карантина файла, по умолчанию stream.DefaultMaxAttempts
+	MaxAttempts *int `yaml:"max_attempts"`
+	// Время в миллисекундах, в течение которого файл не должен меняться
+	// перед копированием, по умолчанию stream.DefaultSettle
+	Settle *int `yaml:"settle"`
+	// Общие шаблоны исключений в формате .gitignore
+	Ignore []string `yaml:"ignore"`
+	// Группы синхронизируемых между собой директорий
+	Groups []Group `yaml:"groups"`
+
+	file string
+	root *yaml.Node
+}
+
+// Группа директорий, синхронизируемых между собой
+type Group struct {
+	Name     string   `yaml:"name"`
+	Dirs     []string `yaml:"dirs"`
+	Interval int      `yaml:"interval"`
+	State    string   `yaml:"state"`
+	Hash     *bool    `yaml:"hash"`
+	Poll     *bool    `yaml:"poll"`
+	Conflict string   `yaml:"conflict"`
+	Prefer   string   `yaml:"prefer"`
+	Links    string   `yaml:"links"`
+	Ignore   []string `yaml:"ignore"`
+
+	Versions     *bool `yaml:"versions"`
+	KeepVersions *int  `yaml:"keep_versions"`
+	KeepDays     *int  `yaml:"keep_days"`
+
+	Owner  *bool `yaml:"owner"`
+	Xattrs *bool `yaml:"xattrs"`
+	ACLs   *bool `yaml:"acls"`
+
+	MaxDelete        *int     `yaml:"max_delete"`
+	MaxDeletePercent *float64 `yaml:"max_delete_percent"`
+	AllowMassDelete  *bool    `yaml:"allow_mass_delete"`
+
+	MaxAttempts *int `yaml:"max_attempts"`
+	Settle      *int `yaml:"settle"`
+}
+
+// Ошибка в файле конфигурации с указанием ключа
+type Error struct {
+	File string
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	var str strings.Builder
+	str.WriteString(e.File)
+	if e.Line > 0 {
+		str.WriteString(":" + strconv.Itoa(e.Line))
+	}
+	if e.Key != "" {
+		str.WriteString(": " + e.Key)
+	}
+	str.WriteString(": " + e.Err.Error())
+	return str.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Загрузка и проверка файла конфигурации
+func Load(fileName string) (*Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{file: fileName, root: &yaml.Node{}}
+	err = yaml.Unmarshal(data, cfg.root)
+	if err != nil {
+		return nil, &Error{File: fileName, Err: err}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, &Error{File: fileName, Err: err}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Проверка настроек. Ошибка указывает на ключ с неверным значением
+func (cfg *Config) Validate() error {
+	if len(cfg.Groups) == 0 {
+		return cfg.errorf("groups", "no groups to synchronise")
+	}
+	if cfg.Interval < 0 {
+		return cfg.errorf("interval", "must be positive")
+	}
+	if _, err := stream.ParseConflictPolicy(cfg.Conflict); err != nil {
+		return cfg.errorf("conflict", "%w", err)
+	}
+	if _, err := stream.ParseLinkMode(cfg.Links); err != nil {
+		return cfg.errorf("links", "%w", err)
+	}
+	if cfg.KeepVersions < 0 {
+		return cfg.errorf("keep_versions", "must not be negative")
+	}
+	if cfg.KeepDays < 0 {
+		return cfg.errorf("keep_days", "must not be negative")
+	}
+	if cfg.MaxDelete < 0 {
+		return cfg.errorf("max_delete", "must not be negative")
+	}
+	if cfg.MaxDeletePercent != nil && !validPercent(*cfg.MaxDeletePercent) {
+		return cfg.errorf("max_delete_percent", "must be from 0 to 100")
+	}
+	if cfg.MaxAttempts != nil && *cfg.MaxAttempts < 0 {
+		return cfg.errorf("max_attempts", "must not be negative")
+	}
+	if cfg.Settle != nil && *cfg.Settle < 0 {
+		return cfg.errorf("settle", "must not be negative")
+	}
+
+	names := make(map[string]int)
+	dirs := make(map[string]string)
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		key := fmt.Sprintf("groups[%d]", i)
+
+		if group.Name == "" {
+			group.Name = fmt.Sprintf("group%d", i+1)
+		}
+		if j, ok := names[group.Name]; ok {
+			return cfg.errorf(key+".name", "name %q is already used by groups[%d]",
+				group.Name, j)
+		}
+		names[group.Name] = i
+
+		if group.Interval == 0 {
+			group.Interval = cfg.Interval
+		}
+		if group.Interval <= 0 {
+			return cfg.errorf(key+".interval", "must be set and positive")
+		}
+		if group.State == "" {
+			group.State = "state-" + group.Name + ".json"
+		}
+
+		if len(group.Dirs) < 2 {
+			return cfg.errorf(key+".dirs", "at least two directories are needed")
+		}
+		for j, dir := range group.Dirs {
+			dirKey := fmt.Sprintf("%s.dirs[%d]", key, j)
+			if other, ok := dirs[dir]; ok {
+				return cfg.errorf(dirKey, "%s is already used in %s", dir, other)
+			}
+			dirs[dir] = dirKey
+			// Удалённые директории проверяются при подключении
+			if stream.IsPeer(dir) {
+				if _, _, _, err := stream.ParsePeer(dir); err != nil {
+					return cfg.errorf(dirKey, "%w", err)
+				}
+				continue
+			}
+			info, err := os.Stat(dir)
+			if err != nil {
+				return cfg.errorf(dirKey, "%w", err)
+			}
+			if !info.IsDir() {
+				return cfg.errorf(dirKey, "%s is not a directory", dir)
+			}
+		}
+
+		_, err := cfg.Options(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Директории разных групп тоже не должны пересекаться
+	var all []string
+	for _, group := range cfg.Groups {
+		all = append(all, group.Dirs...)
+	}
+	var overlap *stream.OverlapError
+	if err := stream.CheckRoots(all); errors.As(err, &overlap) {
+		return cfg.errorf(dirs[overlap.Path], "%w", err)
+	} else if err != nil {
+		return cfg.errorf("groups", "%w", err)
+	}
+	return nil
+}
+
+// Получение настроек синхронизации группы
+func (cfg *Config) Options(i int) (stream.Options, error) {
+	group := cfg.Groups[i]
+	key := fmt.Sprintf("groups[%d]", i)
+	opts := stream.Options{
+		Hash:         cfg.Hash,
+		Poll:         cfg.Poll,
+		PreferDir:    cfg.Prefer,
+		Ignore:       append(slices.Clone(cfg.Ignore), group.Ignore...),
+		Versions:     cfg.Versions,
+		KeepVersions: cfg.KeepVersions,
+		KeepDays:     cfg.KeepDays,
+		Owner:        cfg.Owner,
+		Xattrs:       cfg.Xattrs,
+		ACLs:         cfg.ACLs,
+
+		MaxDelete:        cfg.MaxDelete,
+		MaxDeletePercent: stream.DefaultMaxDeletePercent,
+		AllowMassDelete:  cfg.AllowMassDelete,
+
+		MaxAttempts: stream.DefaultMaxAttempts,
+		Settle:      stream.DefaultSettle,
+	}
+	if cfg.MaxDeletePercent != nil {
+		opts.MaxDeletePercent = *cfg.MaxDeletePercent
+	}
+	if cfg.MaxAttempts != nil {
+		opts.MaxAttempts = *cfg.MaxAttempts
+	}
+	if cfg.Settle != nil {
+		opts.Settle = time.Duration(*cfg.Settle) * time.Millisecond
+	}
+	if group.Hash != nil {
+		opts.Hash = *group.Hash
+	}
+	if group.Poll != nil {
+		opts.Poll = *group.Poll
+	}
+	if group.Versions != nil {
+		opts.Versions = *group.Versions
+	}
+	if group.KeepVersions != nil {
+		opts.KeepVersions = *group.KeepVersions
+		if opts.KeepVersions < 0 {
+			return opts, cfg.errorf(key+".keep_versions", "must not be negative")
+		}
+	}
+	if group.KeepDays != nil {
+		opts.KeepDays = *group.KeepDays
+		if opts.KeepDays < 0 {
+			return opts, cfg.errorf(key+".keep_days", "must not be negative")
+		}
+	}
+	if group.Owner != nil {
+		opts.Owner = *group.Owner
+	}
+	if group.Xattrs != nil {
+		opts.Xattrs = *group.Xattrs
+	}
+	if group.ACLs != nil {
+		opts.ACLs = *group.ACLs
+	}
+	if group.MaxDelete != nil {
+		opts.MaxDelete = *group.MaxDelete
+		if opts.MaxDelete < 0 {
+			return opts, cfg.errorf(key+".max_delete", "must not be negative")
+		}
+	}
+	if group.MaxDeletePercent != nil {
+		opts.MaxDeletePercent = *group.MaxDeletePercent
+		if !validPercent(opts.MaxDeletePercent) {
+			return opts, cfg.errorf(key+".max_delete_percent", "must be from 0 to 100")
+		}
+	}
+	if group.AllowMassDelete != nil {
+		opts.AllowMassDelete = *group.AllowMassDelete
+	}
+	if group.MaxAttempts != nil {
+		opts.MaxAttempts = *group.MaxAttempts
+		if opts.MaxAttempts < 0 {
+			return opts, cfg.errorf(key+".max_attempts", "must not be negative")
+		}
+	}
+	if group.Settle != nil {
+		if *group.Settle < 0 {
+			return opts, cfg.errorf(key+".settle", "must not be negative")
+		}
+		opts.Settle = time.Duration(*group.Settle) * time.Millisecond
+	}
+
+	conflict, conflictKey := cfg.Conflict, "conflict"
+	if group.Conflict != "" {
+		conflict, conflictKey = group.Conflict, key+".conflict"
+	}
+	policy, err := stream.ParseConflictPolicy(conflict)
+	if err != nil {
+		return opts, cfg.errorf(conflictKey, "%w", err)
+	}
+	opts.Conflict = policy
+
+	links, linksKey := cfg.Links, "links"
+	if group.Links != "" {
+		links, linksKey = group.Links, key+".links"
+	}
+	mode, err := stream.ParseLinkMode(links)
+	if err != nil {
+		return opts, cfg.errorf(linksKey, "%w", err)
+	}
+	opts.Links = mode
+
+	preferKey := "prefer"
+	if group.Prefer != "" {
+		opts.PreferDir, preferKey = group.Prefer, key+".prefer"
+	}
+	if policy == stream.ConflictPrefer {
+		if !slices.Contains(group.Dirs, opts.PreferDir) {
+			return opts, cfg.errorf(preferKey, "directory %q is not in %s.dirs",
+				opts.PreferDir, key)
+		}
+	}
+	return opts, nil
+}
+
+// Создание ошибки для ключа вида groups[0].dirs[1]
+func (cfg *Config) errorf(key, format string, args ...any) error {
+	return &Error{
+		File: cfg.file,
+		Line: findLine(cfg.root, key),
+		Key:  key,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// Поиск строки, на которой находится ключ.
+// Если ключа нет в файле, возвращается строка ближайшего родителя
+func findLine(node *yaml.Node, key string) int {
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+
+	for _, part := range strings.Split(key, ".") {
+		name, index := part, -1
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+			index, _ = strconv.Atoi(strings.TrimSuffix(part[i+1:], "]"))
+		}
+
+		next := mapValue(node, name)
+		if next == nil {
+			return line
+		}
+		node, line = next, next.Line
+		if index < 0 {
+			continue
+		}
+		if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+			return line
+		}
+		node = node.Content[index]
+		line = node.Line
+	}
+	return line
+}
+
+// Получение значения по ключу из узла-словаря
+func mapValue(node *yaml.Node, name string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Проверка, что процент находится в допустимых пределах
+func validPercent(percent float64) bool {
+	return percent >= 0 && percent <= 100
+}
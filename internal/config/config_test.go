@@ -0,0 +1,88 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Запись файла конфигурации во временную директорию
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(fileName, []byte(text), 0644))
+	return fileName
+}
+
+func TestLoad(t *testing.T) {
+	req := require.New(t)
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	fileName := writeConfig(t, `
+log: sync.log
+interval: 100
+conflict: keep-both
+groups:
+  - name: photos
+    dirs: [`+dir1+`, `+dir2+`]
+    hash: true
+    conflict: prefer
+    prefer: `+dir2+`
+`)
+
+	cfg, err := Load(fileName)
+	req.NoError(err)
+	req.Equal("sync.log", cfg.Log)
+	req.Len(cfg.Groups, 1)
+	req.Equal(100, cfg.Groups[0].Interval)
+	req.Equal("state-photos.json", cfg.Groups[0].State)
+
+	opts, err := cfg.Options(0)
+	req.NoError(err)
+	req.True(opts.Hash)
+	req.Equal(dir2, opts.PreferDir)
+}
+
+func TestLoadErrorKey(t *testing.T) {
+	req := require.New(t)
+	dir1 := t.TempDir()
+	fileName := writeConfig(t, `interval: 100
+groups:
+  - dirs:
+      - `+dir1+`
+      - /not/existing/dir
+`)
+
+	_, err := Load(fileName)
+	var cfgErr *Error
+	req.ErrorAs(err, &cfgErr)
+	req.Equal("groups[0].dirs[1]", cfgErr.Key)
+	req.Equal(5, cfgErr.Line)
+
+	fileName = writeConfig(t, `groups:
+  - dirs: [`+dir1+`, `+dir1+`]
+`)
+	_, err = Load(fileName)
+	req.ErrorAs(err, &cfgErr)
+	req.Equal("groups[0].interval", cfgErr.Key)
+	req.Equal(2, cfgErr.Line)
+
+	// Вложенные директории разных групп
+	nested := filepath.Join(dir1, "sub")
+	req.NoError(os.Mkdir(nested, 0755))
+	fileName = writeConfig(t, `interval: 100
+groups:
+  - dirs: [`+dir1+`, `+t.TempDir()+`]
+  - dirs: [`+t.TempDir()+`, `+nested+`]
+`)
+	_, err = Load(fileName)
+	req.ErrorAs(err, &cfgErr)
+	req.Equal("groups[1].dirs[1]", cfgErr.Key)
+	req.ErrorContains(err, "is inside")
+
+	fileName = writeConfig(t, `unknown: 1
+`)
+	_, err = Load(fileName)
+	req.ErrorContains(err, "unknown")
+}
@@ -6,8 +6,8 @@ import (
 	"os"
 )
 
-func LogsInit() {
-	logFile, err := os.Create("log.txt")
+func LogsInit(fileName string) {
+	logFile, err := os.Create(fileName)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -0,0 +1,100 @@
+package stream
+
+import (
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Префикс временных файлов, в которые записываются копируемые файлы
+const TmpPrefix = ".sync-tmp-"
+
+// Атомарная запись файла: данные записываются во временный файл
+// в той же директории, сбрасываются на диск, получают права и время
+// изменения, после чего временный файл переименовывается поверх целевого
+func writeAtomic(fsys FS, fullPath string, mode fs.FileMode, modTime time.Time, write func(file File) error) error {
+	file, err := fsys.CreateTemp(filepath.Dir(fullPath), TmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	return finishAtomic(fsys, file, fullPath, mode, modTime, write)
+}
+
+// Завершение атомарной записи в уже созданный временный файл.
+// При ошибке временный файл удаляется
+func finishAtomic(fsys FS, file File, fullPath string, mode fs.FileMode, modTime time.Time, write func(file File) error) error {
+	tmpName := file.Name()
+	done := false
+	defer func() {
+		if !done {
+			file.Close()
+			fsys.Remove(tmpName)
+		}
+	}()
+
+	err := write(file)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = fsys.Chmod(tmpName, mode&modeBits)
+	if err != nil {
+		return err
+	}
+	err = fsys.Chtimes(tmpName, modTime, modTime)
+	if err != nil {
+		return err
+	}
+	err = fsys.Rename(tmpName, fullPath)
+	if err != nil {
+		return err
+	}
+	done = true
+
+	// Сброс на диск директории, чтобы переименование пережило сбой
+	fsSyncDir(fsys, filepath.Dir(fullPath))
+	return nil
+}
+
+// Удаление временных файлов, оставшихся после аварийного завершения
+func CleanTemp(fsys FS, path string) error {
+	return cleanTempDir(fsys, path, path)
+}
+
+// Удаление временных файлов из директории dir и вложенных в неё директорий
+func cleanTempDir(fsys FS, path, dir string) error {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fullPath := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			err = cleanTempDir(fsys, path, fullPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(entry.Name(), TmpPrefix) {
+			continue
+		}
+		err = fsys.Remove(fullPath)
+		if err != nil {
+			return err
+		}
+		slog.Info("Temporary file removed",
+			"Path", path,
+			"File", fullPath)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package stream
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Копирование файла средствами файловой системы: общие блоки через
+// FICLONE, если файловая система это поддерживает, иначе copy_file_range.
+// Возвращает errors.ErrUnsupported, если ядро не может скопировать файл само
+func cloneFile(dst, src *os.File, size int64) error {
+	if unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil {
+		return nil
+	}
+	copied := int64(0)
+	for copied < size {
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(min(size-copied, copyChunk)), 0)
+		if err != nil {
+			if copied == 0 && (errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) ||
+				errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP)) {
+				return errors.ErrUnsupported
+			}
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		copied += int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package stream
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalClone(t *testing.T) {
+	req := require.New(t)
+	name := filepath.Join(t.TempDir(), "image.bin")
+	data := make([]byte, 3<<20+7)
+	rand.New(rand.NewSource(1)).Read(data)
+	req.NoError(os.WriteFile(name, data, 0644))
+
+	file, err := LocalFS{}.Clone(name, TmpPrefix+"*")
+	req.NoError(err)
+	req.NoError(file.Close())
+	got, err := os.ReadFile(file.Name())
+	req.NoError(err)
+	req.Equal(data, got)
+	req.Equal(filepath.Dir(name), filepath.Dir(file.Name()))
+}
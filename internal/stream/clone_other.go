@@ -0,0 +1,13 @@
+//go:build !linux
+
+package stream
+
+import (
+	"errors"
+	"os"
+)
+
+// Копирование файла средствами файловой системы. На других системах не поддерживается
+func cloneFile(dst, src *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Способ разрешения конфликта, когда файл изменён в нескольких директориях
+type ConflictPolicy string
+
+const (
+	// Побеждает файл с более поздним временем изменения
+	ConflictNewest ConflictPolicy = "newest"
+	// Проигравший файл сохраняется рядом под именем name.conflict-<dir>-<time>
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+	// Побеждает файл из заданной директории
+	ConflictPrefer ConflictPolicy = "prefer"
+)
+
+// Формат времени в имени копии конфликтующего файла
+const conflictTimeFormat = "20060102-150405"
+
+// Версия файла, известная для директории на момент последней синхронизации
+type Version struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+// Проверка названия способа разрешения конфликтов
+func ParseConflictPolicy(str string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(str); policy {
+	case ConflictNewest, ConflictKeepBoth, ConflictPrefer:
+		return policy, nil
+	case "":
+		return ConflictNewest, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", str)
+}
+
+// Получение текущей версии файла из буфера
+func (fInfo *FileInfo) version() Version {
+	return Version{
+		ModTime: (*fInfo).ModTime,
+		Size:    (*fInfo).Size,
+		Hash:    (*fInfo).Hash,
+	}
+}
+
+// Проверка, что файл в директории изменён с момента последней синхронизации
+// этой директории. Если директория ещё не синхронизировала файл,
+// то файл считается изменённым
+func (buf *BufInfo) changedSinceSync(path, fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	ver, ok := (*fInfo).Seen[path]
+	if !ok {
+		return true
+	}
+	if !ver.ModTime.Equal(info.ModTime()) || ver.Size != info.Size() {
+		return true
+	}
+	if !(*buf).opts.Hash || ver.Hash == "" {
+		return false
+	}
+	hash, err := buf.fileHash(fullPath, info)
+	if err != nil {
+		return true
+	}
+	return hash != ver.Hash
+}
+
+// Проверка, что в конфликте побеждает файл из директории path.
+// При сохранении обеих версий побеждает файл из буфера
+func (buf *BufInfo) localWins(path, name string, info os.FileInfo, fInfo *FileInfo) bool {
+	switch (*buf).opts.Conflict {
+	case ConflictPrefer:
+		prefer := (*buf).opts.PreferDir
+		if path == prefer {
+			return true
+		} else if (*fInfo).From == filepath.Join(prefer, name) {
+			return false
+		}
+	case ConflictKeepBoth:
+		return false
+	}
+	return info.ModTime().After((*fInfo).ModTime)
+}
+
+// Разрешение конфликта между изменённым файлом в директории и
+// файлом в буфере, изменённым в другой директории.
+// Возвращает true, если побеждает файл из директории
+func (buf *BufInfo) resolveConflict(path, name string, info os.FileInfo, fInfo *FileInfo) (bool, error) {
+	policy := (*buf).opts.Conflict
+	local := buf.localWins(path, name, info, fInfo)
+
+	if policy == ConflictKeepBoth {
+		fullPath := filepath.Join(path, name)
+		copyPath := conflictName(path, fullPath, time.Now())
+		buf.touchDir(path, name)
+		err := buf.fsys().Rename(fullPath, copyPath)
+		if err != nil {
+			return false, err
+		}
+		buf.dropHash(fullPath)
+		buf.addStats(Stats{Conflicts: 1})
+		slog.Warn("Conflict",
+			"Path", path,
+			"File", name,
+			"Policy", string(policy),
+			"Copy", copyPath)
+		return false, nil
+	}
+
+	winner := (*fInfo).From
+	if local {
+		winner = filepath.Join(path, name)
+	}
+	buf.addStats(Stats{Conflicts: 1})
+	slog.Warn("Conflict",
+		"Path", path,
+		"File", name,
+		"Policy", string(policy),
+		"Winner", winner)
+	return local, nil
+}
+
+// Имя копии конфликтующего файла
+func conflictName(path, fullPath string, tm time.Time) string {
+	return fmt.Sprintf("%s.conflict-%s-%s", fullPath,
+		filepath.Base(path), tm.Format(conflictTimeFormat))
+}
@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Размер буфера для копирования файлов без помощи ядра
+const copyBufSize = 1 << 20
+
+// Копирование данных через буфер фиксированного размера
+// с проверкой отмены контекста после каждого блока
+func copyBuffer(dst io.Writer, src io.Reader, ctx context.Context) error {
+	data := make([]byte, copyBufSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := src.Read(data)
+		if n > 0 {
+			_, werr := dst.Write(data[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Копирование данных между файлами любой файловой системы.
+// Файлы на локальном диске копируются средствами ядра
+func copyData(dst io.Writer, src io.Reader, ctx context.Context) error {
+	dFile, dOk := dst.(*os.File)
+	sFile, sOk := src.(*os.File)
+	if dOk && sOk {
+		return copyFile(dFile, sFile, ctx)
+	}
+	return copyBuffer(dst, src, ctx)
+}
+
+// Размер блока, копируемого между локальными файлами за один вызов
+const copyChunk = 8 << 20
+
+// Копирование локального файла блоками. (*os.File).ReadFrom сам выбирает
+// copy_file_range, sendfile или буфер, а между блоками проверяется отмена контекста
+func copyFile(dst, src *os.File, ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := io.CopyN(dst, src, copyChunk)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Минимальный размер файла, который передаётся разницей с его текущей копией
+const deltaMinSize = 1 << 18
+
+// Границы размера блока сигнатуры
+const (
+	deltaMinBlock = 2 << 10
+	deltaMaxBlock = 128 << 10
+)
+
+// Максимальный размер одного куска новых данных в разнице
+const deltaLiteralMax = 256 << 10
+
+// Контрольные суммы блока файла: слабая скользящая для быстрого
+// поиска и сильная для проверки совпадения
+type BlockSum struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// Операция разницы: копирование блока Block текущей копии
+// или запись новых данных Data по смещению Offset в новом файле
+type DeltaOp struct {
+	Offset int64
+	Block  int64
+	Data   []byte
+}
+
+// Скользящая контрольная сумма окна, как в rsync
+type rollSum struct {
+	a, b uint32
+	n    uint32
+}
+
+// Вычисление суммы окна целиком
+func (sum *rollSum) init(data []byte) {
+	sum.a, sum.b = 0, 0
+	sum.n = uint32(len(data))
+	for i, c := range data {
+		sum.a += uint32(c)
+		sum.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+// Сдвиг окна на один байт: out выходит из окна, in входит в него
+func (sum *rollSum) roll(out, in byte) {
+	sum.a += uint32(in) - uint32(out)
+	sum.b += sum.a - sum.n*uint32(out)
+}
+
+func (sum *rollSum) value() uint32 {
+	return sum.a&0xffff | sum.b<<16
+}
+
+// Сильная контрольная сумма блока
+func strongSum(data []byte) [16]byte {
+	var strong [16]byte
+	full := sha256.Sum256(data)
+	copy(strong[:], full[:])
+	return strong
+}
+
+// Размер блока сигнатуры для файла: корень из размера,
+// чтобы сигнатура и точность поиска росли одинаково
+func deltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size)))
+	block = (block + 1023) &^ 1023
+	return min(max(block, deltaMinBlock), deltaMaxBlock)
+}
+
+// Вычисление сигнатуры файла: контрольных сумм всех его полных блоков
+func fileSignature(r io.Reader, blockSize int) ([]BlockSum, error) {
+	var sums []BlockSum
+	data := make([]byte, blockSize)
+	for {
+		_, err := io.ReadFull(r, data)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sum rollSum
+		sum.init(data)
+		sums = append(sums, BlockSum{Weak: sum.value(), Strong: strongSum(data)})
+	}
+}
+
+// Поиск в данных блоков из сигнатуры. Операции передаются в emit
+// по порядку, смещения в новом файле отсчитываются от offset.
+// В памяти хранится не больше одного блока и одного куска новых данных
+func scanDelta(r io.Reader, sums []BlockSum, blockSize int, offset int64, emit func(op DeltaOp) error) error {
+	index := make(map[uint32][]int64, len(sums))
+	for i, sum := range sums {
+		index[sum.Weak] = append(index[sum.Weak], int64(i))
+	}
+
+	data := make([]byte, 0, blockSize+deltaLiteralMax+1)
+	// Начало окна и начало ещё не отправленных новых данных
+	pos, lit := 0, 0
+	eof := false
+	fresh := true
+	var sum rollSum
+
+	flush := func(end int) error {
+		if end <= lit {
+			return nil
+		}
+		err := emit(DeltaOp{Offset: offset, Data: slices.Clone(data[lit:end])})
+		if err != nil {
+			return err
+		}
+		offset += int64(end - lit)
+		lit = end
+		return nil
+	}
+
+	for {
+		// Для сдвига окна нужен ещё один байт после него
+		need := pos + blockSize
+		if !fresh {
+			need++
+		}
+		if len(data) < need && !eof {
+			if len(data) == cap(data) {
+				err := flush(pos)
+				if err != nil {
+					return err
+				}
+				n := copy(data, data[pos:])
+				data = data[:n]
+				pos, lit = 0, 0
+			}
+			n, err := r.Read(data[len(data):cap(data)])
+			data = data[:len(data)+n]
+			if errors.Is(err, io.EOF) {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(data) < need {
+			break
+		}
+
+		if fresh {
+			sum.init(data[pos : pos+blockSize])
+			fresh = false
+		} else {
+			sum.roll(data[pos], data[pos+blockSize])
+			pos++
+		}
+
+		if block, ok := findBlock(index[sum.value()], sums, data[pos:pos+blockSize], blockSize, offset+int64(pos-lit)); ok {
+			err := flush(pos)
+			if err != nil {
+				return err
+			}
+			err = emit(DeltaOp{Offset: offset, Block: block})
+			if err != nil {
+				return err
+			}
+			offset += int64(blockSize)
+			pos += blockSize
+			lit = pos
+			fresh = true
+			continue
+		}
+
+		if pos-lit >= deltaLiteralMax {
+			err := flush(pos)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return flush(len(data))
+}
+
+// Поиск блока среди кандидатов с той же слабой суммой. Блок, который уже
+// находится на нужном месте в текущей копии, выбирается в первую очередь
+func findBlock(candidates []int64, sums []BlockSum, window []byte, blockSize int, at int64) (int64, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(window)
+	found := int64(-1)
+	for _, block := range candidates {
+		if sums[block].Strong != strong {
+			continue
+		}
+		if block*int64(blockSize) == at {
+			return block, true
+		}
+		if found < 0 {
+			found = block
+		}
+	}
+	return found, found >= 0
+}
+
+// Вычисление сигнатуры файла там, где он хранится
+func fsSignature(fsys FS, name string, blockSize int) ([]BlockSum, error) {
+	if dfs, ok := fsys.(DeltaFS); ok {
+		return dfs.Signature(name, blockSize)
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return fileSignature(file, blockSize)
+}
+
+// Вычисление разницы файла с сигнатурой там, где он хранится
+func fsDelta(fsys FS, name string, sums []BlockSum, blockSize int, emit func(op DeltaOp) error) error {
+	if dfs, ok := fsys.(DeltaFS); ok {
+		return dfs.Delta(name, sums, blockSize, emit)
+	}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanDelta(file, sums, blockSize, 0, emit)
+}
+
+// Создание временной копии файла в той же директории. Если файловая
+// система не умеет копировать сама, данные копируются через клиента
+func fsClone(fsys FS, name, pattern string, ctx context.Context) (File, error) {
+	if cfs, ok := fsys.(CloneFS); ok {
+		file, err := cfs.Clone(name, pattern)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return file, err
+		}
+	}
+	src, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	file, err := fsys.CreateTemp(filepath.Dir(name), pattern)
+	if err != nil {
+		return nil, err
+	}
+	err = copyData(file, src, ctx)
+	if err != nil {
+		file.Close()
+		fsys.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// Запись файла по разнице с его текущей копией: копия дублируется,
+// а в дубликат записываются только изменённые и перемещённые участки.
+// Возвращает false, если текущей копии нет или она слишком мала.
+// before - состояние исходного файла до начала передачи
+func (buf *BufInfo) buildDelta(fullPath string, fInfo *FileInfo, before os.FileInfo, ctx context.Context) (bool, error) {
+	fsys := buf.fsys()
+	info, err := fsys.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() ||
+		info.Size() < deltaMinSize || (*fInfo).Size < deltaMinSize {
+		return false, nil
+	}
+
+	basis, err := fsys.Open(fullPath)
+	if err != nil {
+		return false, err
+	}
+	defer basis.Close()
+
+	blockSize := deltaBlockSize(info.Size())
+	sums, err := fsSignature(fsys, fullPath, blockSize)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := fsClone(fsys, fullPath, TmpPrefix+"*", ctx)
+	if err != nil {
+		return false, err
+	}
+	var kept, moved, literal int64
+	err = finishAtomic(fsys, file, fullPath, (*fInfo).Mode, (*fInfo).ModTime,
+		func(file File) error {
+			var size int64
+			block := make([]byte, blockSize)
+			err := fsDelta(fsys, (*fInfo).From, sums, blockSize, func(op DeltaOp) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if len(op.Data) > 0 {
+					size = op.Offset + int64(len(op.Data))
+					literal += int64(len(op.Data))
+					_, err := file.WriteAt(op.Data, op.Offset)
+					return err
+				}
+				size = op.Offset + int64(blockSize)
+				// Блок уже находится на своём месте в дубликате
+				from := op.Block * int64(blockSize)
+				if from == op.Offset {
+					kept += int64(blockSize)
+					return nil
+				}
+				moved += int64(blockSize)
+				return moveBlock(file, basis, fullPath, from, op.Offset, block)
+			})
+			if err != nil {
+				return err
+			}
+			err = file.Truncate(size)
+			if err != nil {
+				return err
+			}
+			err = buf.checkSource((*fInfo).From, before)
+			if err != nil {
+				return err
+			}
+			return buf.applyOwner(file.Name(), fInfo)
+		})
+	if err != nil {
+		return false, err
+	}
+	slog.Debug("Delta transfer",
+		"File", fullPath,
+		"Kept", kept,
+		"Moved", moved,
+		"Literal", literal)
+	return true, nil
+}
+
+// Перенос блока текущей копии на новое место в дубликате. Если файловая
+// система умеет, блок копируется на её стороне без передачи через клиента
+func moveBlock(file File, basis io.Reader, basisName string, from, to int64, block []byte) error {
+	if rfile, ok := file.(RangeFile); ok {
+		return rfile.CopyRange(basisName, from, to, len(block))
+	}
+	basisAt, ok := basis.(io.ReaderAt)
+	if !ok {
+		return &fs.PathError{Op: "readat", Path: basisName, Err: errors.ErrUnsupported}
+	}
+	_, err := basisAt.ReadAt(block, from)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(block, to)
+	return err
+}
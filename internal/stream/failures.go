@@ -0,0 +1,227 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Файл в корне директории со списком файлов, ошибки которых нужно сбросить.
+// Пустой файл сбрасывает ошибки всех файлов директории
+const RetryFile = ".sync_retry"
+
+// Количество неудачных попыток подряд, после которого файл помещается в карантин
+const DefaultMaxAttempts = 10
+
+// Задержка перед повторной операцией с файлом после первой ошибки
+// и максимальная задержка
+const (
+	fileRetryBase = time.Second
+	fileRetryMax  = time.Hour
+)
+
+// Ошибка операции с файлом директории
+type Failure struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Op       string    `json:"op"`
+	Err      string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Last     time.Time `json:"last"`
+	// Время, до которого операция с файлом не повторяется
+	Next time.Time `json:"next"`
+	// Операция не повторяется, пока ошибка не будет сброшена
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// Сброс ошибок файлов директории. Ошибки сбрасываются синхронизацией
+// при следующем цикле, пустой список names сбрасывает все ошибки директории
+func ClearFailures(fsys FS, path string, names []string) error {
+	data := strings.Join(names, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	return writeAtomic(fsys, filepath.Join(path, RetryFile), 0644, time.Now(),
+		func(file File) error {
+			_, err := file.Write([]byte(data))
+			return err
+		})
+}
+
+// Чтение ошибок файлов из сохранённого состояния
+func LoadFailures(fileName string) ([]Failure, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var state stateInfo
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return state.Failures, nil
+}
+
+// Ключ ошибки файла в реестре
+func failureKey(path, name string) string {
+	return filepath.Join(path, name)
+}
+
+// Запись ошибки операции с файлом. Следующая попытка откладывается
+// вдвое дольше предыдущей, а после MaxAttempts попыток файл помещается в карантин
+func (buf *BufInfo) fileFailed(path, name, op string, err error) {
+	buf.countError()
+
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	key := failureKey(path, name)
+	failure, ok := (*buf).failures[key]
+	if !ok {
+		failure = &Failure{Path: path, Name: name}
+		(*buf).failures[key] = failure
+	}
+	now := time.Now()
+	failure.Op = op
+	failure.Err = err.Error()
+	failure.Attempts++
+	failure.Last = now
+	delay := fileRetryBase
+	for i := 1; i < failure.Attempts && delay < fileRetryMax; i++ {
+		delay *= 2
+	}
+	failure.Next = now.Add(min(delay, fileRetryMax))
+
+	limit := (*buf).opts.MaxAttempts
+	if limit > 0 && failure.Attempts >= limit && !failure.Quarantined {
+		failure.Quarantined = true
+		slog.Error("File is quarantined",
+			"Path", path,
+			"File", name,
+			"Operation", op,
+			"Attempts", failure.Attempts,
+			"Error", err)
+	}
+}
+
+// Проверка, что с файлом можно выполнять операции:
+// он не в карантине и задержка после ошибки прошла
+func (buf *BufInfo) canRetry(path, name string) bool {
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	failure, ok := (*buf).failures[failureKey(path, name)]
+	if !ok {
+		return true
+	}
+	return !failure.Quarantined && !time.Now().Before(failure.Next)
+}
+
+// Проверка, что в директории есть файлы, операции с которыми пора повторить
+func (buf *BufInfo) retryDue(path string) bool {
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	now := time.Now()
+	for _, failure := range (*buf).failures {
+		if failure.Path == path && !failure.Quarantined && !now.Before(failure.Next) {
+			return true
+		}
+	}
+	return false
+}
+
+// Удаление ошибки файла после успешной операции
+func (buf *BufInfo) fileDone(path, name string) {
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	key := failureKey(path, name)
+	failure, ok := (*buf).failures[key]
+	if !ok {
+		return
+	}
+	delete((*buf).failures, key)
+	slog.Info("File is recovered",
+		"Path", path,
+		"File", name,
+		"Attempts", failure.Attempts)
+}
+
+// Получение ошибок файлов, упорядоченных по директории и имени
+func (buf *BufInfo) Failures() []Failure {
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	list := make([]Failure, 0, len((*buf).failures))
+	for _, failure := range (*buf).failures {
+		list = append(list, *failure)
+	}
+	slices.SortFunc(list, func(a, b Failure) int {
+		return strings.Compare(failureKey(a.Path, a.Name), failureKey(b.Path, b.Name))
+	})
+	return list
+}
+
+// Сброс ошибок файлов names директории, пустой список сбрасывает все.
+// Возвращает количество сброшенных ошибок
+func (buf *BufInfo) clearFailures(path string, names []string) int {
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	cleared := 0
+	for key, failure := range (*buf).failures {
+		if failure.Path != path {
+			continue
+		}
+		if len(names) > 0 && !slices.Contains(names, failure.Name) {
+			continue
+		}
+		delete((*buf).failures, key)
+		cleared++
+	}
+	return cleared
+}
+
+// Удаление ошибок файлов, которых больше нет в буфере
+func (buf *BufInfo) dropStaleFailures(path string) {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	(*buf).failMu.Lock()
+	defer (*buf).failMu.Unlock()
+	for key, failure := range (*buf).failures {
+		if failure.Path != path {
+			continue
+		}
+		if _, ok := (*buf).files[failure.Name]; !ok {
+			delete((*buf).failures, key)
+		}
+	}
+}
+
+// Выполнение запроса на сброс ошибок, оставленного в корне директории
+func (buf *BufInfo) consumeRetry(path string) {
+	retryPath := filepath.Join(path, RetryFile)
+	if _, err := buf.fsys().Stat(retryPath); err != nil {
+		return
+	}
+	file, err := buf.fsys().Open(retryPath)
+	if err != nil {
+		return
+	}
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, filepath.Clean(name))
+		}
+	}
+	file.Close()
+	if scanner.Err() != nil || buf.fsys().Remove(retryPath) != nil {
+		return
+	}
+
+	cleared := buf.clearFailures(path, names)
+	slog.Info("File failures are cleared",
+		"Path", path,
+		"Failures", cleared)
+}
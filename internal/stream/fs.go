@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Файловая система, с которой работает синхронизация.
+// Имена файлов передаются полностью, вместе с синхронизируемой директорией
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Readlink(name string) (string, error)
+	Open(name string) (io.ReadCloser, error)
+	// Создание нового файла для записи с уникальным именем по шаблону os.CreateTemp
+	CreateTemp(dir, pattern string) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Symlink(target, name string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// Файл, открытый для записи
+type File interface {
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Файловая система, умеющая менять время изменения самой ссылки
+type LchtimesFS interface {
+	Lchtimes(name string, mtime time.Time) error
+}
+
+// Файловая система с владельцами файлов
+type OwnerFS interface {
+	Lchown(name string, uid, gid int) error
+}
+
+// Файловая система с расширенными атрибутами.
+// Обрабатываются только атрибуты, отобранные функцией keep
+type XattrFS interface {
+	ReadXattrs(name string, keep func(string) bool) (map[string][]byte, error)
+	WriteXattrs(name string, attrs map[string][]byte, keep func(string) bool) error
+}
+
+// Файловая система с жёсткими ссылками
+type LinkFS interface {
+	Link(oldName, newName string) error
+}
+
+// Файловая система, в которой существующий файл можно открыть
+// для записи на месте, не создавая копию
+type OpenFileFS interface {
+	OpenFile(name string) (File, error)
+}
+
+// Файловая система, требующая сброса директории на диск после переименования
+type SyncDirFS interface {
+	SyncDir(name string) error
+}
+
+// Файловая система, которая сама вычисляет сигнатуры файлов
+// и их разницу с сигнатурой, не передавая содержимое файлов
+type DeltaFS interface {
+	Signature(name string, blockSize int) ([]BlockSum, error)
+	Delta(name string, sums []BlockSum, blockSize int, emit func(op DeltaOp) error) error
+}
+
+// Файловая система, которая сама создаёт временную копию файла
+// в его директории. Возвращает errors.ErrUnsupported, если не может
+type CloneFS interface {
+	Clone(name, pattern string) (File, error)
+}
+
+// Файл, в который участок другого файла той же файловой системы
+// копируется без передачи данных через клиента
+type RangeFile interface {
+	CopyRange(src string, from, to int64, size int) error
+}
+
+// Получение файловой системы буфера
+func (buf *BufInfo) fsys() FS {
+	if (*buf).opts.FS != nil {
+		return (*buf).opts.FS
+	}
+	return LocalFS{}
+}
+
+// Установка времени изменения ссылки, если файловая система это поддерживает
+func fsLchtimes(fsys FS, name string, mtime time.Time) error {
+	if lfs, ok := fsys.(LchtimesFS); ok {
+		return lfs.Lchtimes(name, mtime)
+	}
+	return nil
+}
+
+// Открытие существующего файла для записи, если файловая система это поддерживает
+func fsOpenFile(fsys FS, name string) (File, error) {
+	if ofs, ok := fsys.(OpenFileFS); ok {
+		return ofs.OpenFile(name)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Открытие файла для чтения с заданного смещения
+func fsOpenAt(fsys FS, name string, offset int64) (io.ReadCloser, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, offset)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Сброс директории на диск, если файловая система этого требует
+func fsSyncDir(fsys FS, name string) {
+	if sfs, ok := fsys.(SyncDirFS); ok {
+		sfs.SyncDir(name)
+	}
+}
+
+// Проверка, что два описания относятся к одному файлу
+func sameFile(a, b fs.FileInfo) bool {
+	if keyA, ok := fileKey(a); ok {
+		keyB, ok := fileKey(b)
+		return ok && keyA == keyB
+	}
+	if a.Sys() != nil && a.Sys() == b.Sys() {
+		return true
+	}
+	return os.SameFile(a, b)
+}
@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Локальная файловая система
+type LocalFS struct{}
+
+func (LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (LocalFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (LocalFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (LocalFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (LocalFS) CreateTemp(dir, pattern string) (File, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+func (LocalFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (LocalFS) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (LocalFS) Symlink(target, name string) error {
+	return os.Symlink(target, name)
+}
+
+func (LocalFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (LocalFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+// Биты setuid, setgid и sticky переводятся os.Chmod в биты системного вызова
+func (LocalFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode&modeBits)
+}
+
+func (LocalFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (LocalFS) Lchtimes(name string, mtime time.Time) error {
+	return lchtimes(name, mtime)
+}
+
+func (LocalFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (LocalFS) ReadXattrs(name string, keep func(string) bool) (map[string][]byte, error) {
+	return readXattrs(name, keep)
+}
+
+func (LocalFS) WriteXattrs(name string, attrs map[string][]byte, keep func(string) bool) error {
+	return writeXattrs(name, attrs, keep)
+}
+
+func (LocalFS) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (LocalFS) OpenFile(name string) (File, error) {
+	return os.OpenFile(name, os.O_WRONLY, 0)
+}
+
+func (LocalFS) Clone(name, pattern string) (File, error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), pattern)
+	if err != nil {
+		return nil, err
+	}
+	err = cloneFile(file, src, info.Size())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalFS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,267 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// Файл в корне директории, разрешающий продолжить приостановленную синхронизацию
+const ConfirmFile = ".sync_confirm"
+
+// Процент удаляемых за цикл файлов, после которого синхронизация приостанавливается
+const DefaultMaxDeletePercent = 50
+
+// Процентный порог не применяется, если за цикл удаляется меньше файлов
+const massDeleteMin = 10
+
+// Состояние синхронизируемой директории
+type rootState struct {
+	// Устройство и inode директории
+	ID fileID
+	// Причина приостановки синхронизации, пустая строка - не приостановлена
+	paused string
+	// Продолжение синхронизации требует подтверждения
+	needConfirm bool
+	// Разрешение одного массового удаления после подтверждения
+	allow bool
+	// Ошибка чтения директории в последнем цикле синхронизации
+	failed error
+	// Директории, вложенные файлы которых синхронизация
+	// меняла в текущем цикле
+	touched map[string]struct{}
+	// Количество не исключённых в директории файлов буфера
+	count *nameCount
+}
+
+// Подтверждение продолжения приостановленной синхронизации директории
+func Confirm(fsys FS, path string) error {
+	return writeAtomic(fsys, filepath.Join(path, ConfirmFile), 0644, time.Now(),
+		func(file File) error { return nil })
+}
+
+// Проверка, что синхронизация директории может быть выполнена.
+// Синхронизация приостанавливается, если директория недоступна
+// или была заменена другой директорией (например, после размонтирования)
+func (buf *BufInfo) checkRoot(path string) bool {
+	info, err := buf.fsys().Stat(path)
+	if err != nil {
+		buf.pauseRoot(path, fmt.Sprintf("directory is unavailable: %v", err), false)
+		return false
+	}
+	if !info.IsDir() {
+		buf.pauseRoot(path, "path is not a directory", false)
+		return false
+	}
+
+	confirmed := false
+	confirmPath := filepath.Join(path, ConfirmFile)
+	if _, err := buf.fsys().Stat(confirmPath); err == nil {
+		confirmed = buf.fsys().Remove(confirmPath) == nil
+	}
+
+	key, hasKey := fileKey(info)
+
+	(*buf).mu.Lock()
+	state, ok := (*buf).roots[path]
+	if !ok {
+		state = &rootState{ID: key}
+		(*buf).roots[path] = state
+	}
+	if state.ID == (fileID{}) {
+		state.ID = key
+	}
+	if confirmed {
+		slog.Warn("Synchronisation is confirmed",
+			"Path", path,
+			"Reason", state.paused)
+		state.paused = ""
+		state.needConfirm = false
+		state.allow = true
+		state.ID = key
+	}
+	changed := hasKey && state.ID != key
+	(*buf).mu.Unlock()
+
+	if changed {
+		buf.pauseRoot(path, "directory is replaced by another one", true)
+		return false
+	}
+
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	if state.paused == "" {
+		return true
+	}
+	// Недоступная директория снова доступна и не была заменена
+	if !state.needConfirm {
+		slog.Warn("Synchronisation is resumed", "Path", path)
+		state.paused = ""
+		return true
+	}
+	return false
+}
+
+// Получение причины, по которой синхронизация директории приостановлена.
+// Пустая строка - синхронизация не приостановлена
+func (buf *BufInfo) Paused(path string) string {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	if state, ok := (*buf).roots[path]; ok {
+		return state.paused
+	}
+	return ""
+}
+
+// Проверка, что продолжение синхронизации директории требует подтверждения
+func (buf *BufInfo) NeedConfirm(path string) bool {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	if state, ok := (*buf).roots[path]; ok {
+		return state.needConfirm
+	}
+	return false
+}
+
+// Запись ошибки чтения директории в цикле синхронизации. nil - директория прочитана
+func (buf *BufInfo) setRootError(path string, err error) {
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	state, ok := (*buf).roots[path]
+	if !ok {
+		state = &rootState{}
+		(*buf).roots[path] = state
+	}
+	state.failed = err
+}
+
+// Получение ошибки, из-за которой последний цикл синхронизации директории
+// не был выполнен: директория недоступна, заменена или не читается.
+// Ожидание подтверждения ошибкой не считается, такая директория
+// проверяется с обычным интервалом
+func (buf *BufInfo) rootError(path string) error {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	state, ok := (*buf).roots[path]
+	if !ok {
+		return nil
+	}
+	if state.paused != "" && !state.needConfirm {
+		return errors.New(state.paused)
+	}
+	return state.failed
+}
+
+// Приостановка синхронизации директории с записью причины в лог
+func (buf *BufInfo) pauseRoot(path, reason string, confirm bool) {
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	state, ok := (*buf).roots[path]
+	if !ok {
+		state = &rootState{}
+		(*buf).roots[path] = state
+	}
+	if state.paused == reason && state.needConfirm == confirm {
+		return
+	}
+	state.paused = reason
+	state.needConfirm = confirm
+	if confirm {
+		slog.Error("Synchronisation is paused, confirmation is needed",
+			"Path", path,
+			"Reason", reason,
+			"Command", "confirm "+path)
+	} else {
+		slog.Error("Synchronisation is paused",
+			"Path", path,
+			"Reason", reason)
+	}
+}
+
+// Проверка количества файлов, которые будут удалены из буфера за цикл.
+// Если их больше заданного порога, синхронизация директории приостанавливается.
+// Переименованные файлы (inode которых остался в директории) не учитываются
+func (buf *BufInfo) allowDeletes(path string, arr []string, ig *Ignore, inodes map[fileID]string) bool {
+	opts := (*buf).opts
+	if opts.AllowMassDelete || (opts.MaxDelete <= 0 && opts.MaxDeletePercent <= 0) {
+		return true
+	}
+	if len(arr) == 0 {
+		return true
+	}
+
+	(*buf).mu.RLock()
+	moved := make(map[string]struct{})
+	for key, name := range (*buf).inodes[path] {
+		if _, ok := inodes[key]; ok {
+			moved[name] = struct{}{}
+		}
+	}
+	var names []string
+	for _, name := range arr {
+		fInfo, ok := (*buf).files[name]
+		if !ok || !fInfo.findWhere(path) {
+			continue
+		}
+		if _, ok := (*buf).tomb[name]; ok {
+			continue
+		}
+		if _, ok := moved[name]; ok {
+			continue
+		}
+		if ig.Match(name, (*fInfo).IsDir) {
+			continue
+		}
+		names = append(names, name)
+	}
+	state := (*buf).roots[path]
+	(*buf).mu.RUnlock()
+
+	count := 0
+	for _, name := range names {
+		_, err := buf.fsys().Lstat(filepath.Join(path, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			count++
+		}
+	}
+	if count == 0 {
+		return true
+	}
+
+	// Количество файлов директории нужно только при удалении
+	(*buf).mu.RLock()
+	total := 0
+	for _, fInfo := range (*buf).files {
+		if fInfo.findWhere(path) {
+			total++
+		}
+	}
+	(*buf).mu.RUnlock()
+
+	tooMany := opts.MaxDelete > 0 && count > opts.MaxDelete
+	if opts.MaxDeletePercent > 0 && count >= massDeleteMin &&
+		float64(count)*100 > opts.MaxDeletePercent*float64(total) {
+		tooMany = true
+	}
+	if !tooMany {
+		return true
+	}
+
+	(*buf).mu.Lock()
+	if state != nil && state.allow {
+		state.allow = false
+		(*buf).mu.Unlock()
+		slog.Warn("Mass deletion is confirmed",
+			"Path", path,
+			"Files", count,
+			"Total", total)
+		return true
+	}
+	(*buf).mu.Unlock()
+
+	buf.pauseRoot(path, fmt.Sprintf("mass deletion of %d of %d files", count, total), true)
+	return false
+}
@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+)
+
+// Закешированный хеш содержимого файла
+type hashInfo struct {
+	ModTime time.Time
+	Size    int64
+	Ctime   int64
+	Hash    string
+}
+
+// Вычисление хеша содержимого файла
+func HashFile(fsys FS, fullPath string) (string, error) {
+	file, err := fsys.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Получение хеша файла из кеша или его вычисление,
+// если время изменения, размер или ctime файла изменились
+func (buf *BufInfo) fileHash(fullPath string, info os.FileInfo) (string, error) {
+	ctime := changeTime(info)
+
+	(*buf).hashMu.Lock()
+	hInf, ok := (*buf).hashes[fullPath]
+	(*buf).hashMu.Unlock()
+	if ok && hInf.Size == info.Size() && hInf.Ctime == ctime &&
+		hInf.ModTime.Equal(info.ModTime()) {
+		return hInf.Hash, nil
+	}
+
+	hash, err := HashFile(buf.fsys(), fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	(*buf).hashMu.Lock()
+	(*buf).hashes[fullPath] = hashInfo{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Ctime:   ctime,
+		Hash:    hash,
+	}
+	(*buf).hashMu.Unlock()
+	return hash, nil
+}
+
+// Проверка, что файл мог измениться с момента вычисления хеша
+func (buf *BufInfo) hashStale(fullPath string, info os.FileInfo, hash string) bool {
+	(*buf).hashMu.Lock()
+	defer (*buf).hashMu.Unlock()
+	hInf, ok := (*buf).hashes[fullPath]
+	if !ok {
+		return true
+	}
+	if hInf.Size != info.Size() || hInf.Ctime != changeTime(info) ||
+		!hInf.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	return hash != "" && hInf.Hash != hash
+}
+
+// Удаление хеша файла из кеша
+func (buf *BufInfo) dropHash(fullPath string) {
+	(*buf).hashMu.Lock()
+	defer (*buf).hashMu.Unlock()
+	delete((*buf).hashes, fullPath)
+}
+
+// Получение хеша файла из буфера. Если хеш ещё не вычислялся,
+// он вычисляется по файлу-источнику и сохраняется в буфере
+func (buf *BufInfo) bufHash(name string, fInfo *FileInfo) string {
+	if (*fInfo).Hash != "" {
+		return (*fInfo).Hash
+	}
+
+	info, err := buf.fsys().Stat((*fInfo).From)
+	if err != nil {
+		return ""
+	}
+	if info.Size() != (*fInfo).Size || !info.ModTime().Equal((*fInfo).ModTime) {
+		return ""
+	}
+	hash, err := buf.fileHash((*fInfo).From, info)
+	if err != nil {
+		return ""
+	}
+
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	if tmp, ok := (*buf).files[name]; ok && tmp.From == (*fInfo).From &&
+		tmp.ModTime.Equal((*fInfo).ModTime) {
+		tmp.Hash = hash
+	}
+	(*fInfo).Hash = hash
+	return hash
+}
+
+// Проверка, что содержимое файла отличается от содержимого файла в буфере.
+// Если сравнить содержимое не удалось, файл считается изменённым
+func (buf *BufInfo) contentDiffers(name, fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	if info.Size() != (*fInfo).Size || isLink(info) || (*fInfo).IsLink {
+		return true
+	}
+	hash, err := buf.fileHash(fullPath, info)
+	if err != nil {
+		return true
+	}
+	bHash := buf.bufHash(name, fInfo)
+	if bHash == "" {
+		return true
+	}
+	return hash != bHash
+}
+
+// Проверка, что файл в директории отличается от файла в буфере
+func (buf *BufInfo) fileChanged(name, fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	if !fInfo.compareInfo(&info) || !buf.sameLink(fullPath, info, fInfo) {
+		return true
+	}
+	if buf.metaChanged(fullPath, info, fInfo) {
+		return true
+	}
+	if !(*buf).opts.Hash {
+		return false
+	}
+	return buf.contentDiffers(name, fullPath, info, fInfo)
+}
+
+// Проверка, что у изменённого файла совпадает с буфером содержимое,
+// а отличаются только метаданные. Без сравнения по хешу содержимое
+// считается совпадающим, если совпадают размер и время изменения
+func (buf *BufInfo) sameContent(name, fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	if (*buf).opts.Hash {
+		return !buf.contentDiffers(name, fullPath, info, fInfo)
+	}
+	return (*fInfo).Size == info.Size() && (*fInfo).ModTime.Equal(info.ModTime()) &&
+		buf.sameLink(fullPath, info, fInfo)
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Имя файла с шаблонами исключений в корне синхронизируемой директории
+const IgnoreFile = ".syncignore"
+
+// Шаблон исключения в формате .gitignore
+type ignoreRule struct {
+	parts   []string
+	negate  bool
+	dirOnly bool
+}
+
+// Набор шаблонов исключений. Пустой набор ничего не исключает
+type Ignore struct {
+	rules []ignoreRule
+	// Строки шаблонов, из которых собран набор
+	lines []string
+}
+
+// Разбор шаблонов исключений в формате .gitignore:
+// пустые строки и строки с # пропускаются, ! отменяет исключение,
+// / в конце шаблона означает директорию, / в начале или середине
+// привязывает шаблон к корню директории, ** совпадает с любым
+// количеством вложенных директорий
+func ParseIgnore(lines []string) *Ignore {
+	ig := &Ignore{lines: lines}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			rule.parts = []string{"**"}
+		}
+		line = strings.TrimPrefix(line, "/")
+		rule.parts = append(rule.parts, strings.Split(line, "/")...)
+		ig.rules = append(ig.rules, rule)
+	}
+	return ig
+}
+
+// Загрузка шаблонов исключений директории из файла .syncignore
+// вместе с общими шаблонами
+func LoadIgnore(fsys FS, root string, global []string) (*Ignore, error) {
+	lines := append([]string{"/" + IgnoreFile, "/" + VersionsDir + "/", "/" + ConfirmFile, "/" + RetryFile, "/" + LockFile, TmpPrefix + "*"}, global...)
+
+	file, err := fsys.Open(filepath.Join(root, IgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ParseIgnore(lines), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ParseIgnore(lines), nil
+}
+
+// Шаблоны набора в исходном виде, по одному на строку
+func (ig *Ignore) String() string {
+	if ig == nil {
+		return ""
+	}
+	return strings.Join(ig.lines, "\n")
+}
+
+// Проверка, что файл исключён из синхронизации.
+// Файл исключён и тогда, когда исключена одна из его родительских директорий
+func (ig *Ignore) Match(name string, isDir bool) bool {
+	if ig == nil || len(ig.rules) == 0 {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i := 1; i < len(parts); i++ {
+		if ig.matchParts(parts[:i], true) {
+			return true
+		}
+	}
+	return ig.matchParts(parts, isDir)
+}
+
+// Проверка файла без учёта родительских директорий.
+// Используется при обходе, когда родительские директории уже проверены
+func (ig *Ignore) matchName(name string, isDir bool) bool {
+	if ig == nil || len(ig.rules) == 0 {
+		return false
+	}
+	return ig.matchParts(strings.Split(filepath.ToSlash(name), "/"), isDir)
+}
+
+// Применение шаблонов по порядку, последний совпавший шаблон побеждает
+func (ig *Ignore) matchParts(parts []string, isDir bool) bool {
+	ignored := false
+	for _, rule := range ig.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchParts(rule.parts, parts) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Сравнение частей пути с частями шаблона
+func matchParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchParts(pattern[1:], parts[1:])
+}
@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Способ обработки символических ссылок
+type LinkMode string
+
+const (
+	// Ссылки копируются как ссылки с тем же путём назначения
+	LinkPreserve LinkMode = "preserve"
+	// Вместо ссылок копируются файлы и директории, на которые они указывают
+	LinkFollow LinkMode = "follow"
+	// Ссылки не синхронизируются
+	LinkSkip LinkMode = "skip"
+)
+
+// Проверка названия способа обработки ссылок
+func ParseLinkMode(str string) (LinkMode, error) {
+	switch mode := LinkMode(str); mode {
+	case LinkPreserve, LinkFollow, LinkSkip:
+		return mode, nil
+	case "":
+		return LinkPreserve, nil
+	}
+	return "", fmt.Errorf("unknown link mode %q", str)
+}
+
+// Проверка, что файл является символической ссылкой
+func isLink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// Получение информации о файле с учётом способа обработки ссылок
+func (buf *BufInfo) stat(fullPath string) (os.FileInfo, error) {
+	if (*buf).opts.Links == LinkFollow {
+		return buf.fsys().Stat(fullPath)
+	}
+	return buf.fsys().Lstat(fullPath)
+}
+
+// Проверка, что ссылка в директории совпадает со ссылкой в буфере
+func (buf *BufInfo) sameLink(fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	if (*fInfo).IsLink != isLink(info) {
+		return false
+	}
+	if !(*fInfo).IsLink {
+		return true
+	}
+	target, err := buf.fsys().Readlink(fullPath)
+	if err != nil {
+		return false
+	}
+	return target == (*fInfo).Link
+}
+
+// Атомарное создание символической ссылки по образу из буфера
+func buildLink(fsys FS, fullPath, target string, modTime time.Time) error {
+	tmpName := filepath.Join(filepath.Dir(fullPath),
+		fmt.Sprintf("%s%d", TmpPrefix, time.Now().UnixNano()))
+	err := fsys.Symlink(target, tmpName)
+	if err != nil {
+		return err
+	}
+	err = fsLchtimes(fsys, tmpName, modTime)
+	if err == nil {
+		err = fsys.Rename(tmpName, fullPath)
+	}
+	if err != nil {
+		fsys.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package stream
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Установка времени изменения самой ссылки, а не файла, на который она указывает
+func lchtimes(fullPath string, modTime time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(modTime.UnixNano()),
+		unix.NsecToTimespec(modTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, fullPath, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package stream
+
+import "time"
+
+// Установка времени изменения ссылки. На других системах не поддерживается
+func lchtimes(fullPath string, modTime time.Time) error {
+	return nil
+}
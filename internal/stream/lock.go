@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Файл блокировки в корне директории, который держит запущенная синхронизация
+const LockFile = ".sync_lock"
+
+// Директория уже синхронизируется другим процессом
+var ErrLocked = errors.New("directory is locked by another instance")
+
+// Процесс, держащий блокировку директории
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// Блокировка директории, запрещающая её синхронизацию другим процессам
+type RootLock struct {
+	path string
+	file *os.File
+}
+
+// Блокировка директории перед синхронизацией. Если директорию
+// уже синхронизирует живой процесс, возвращается ErrLocked.
+// Блокировка, оставшаяся после аварийного завершения, перехватывается
+func LockRoot(path string) (*RootLock, error) {
+	lockPath := filepath.Join(path, LockFile)
+	host, _ := os.Hostname()
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		prev, _ := readLockInfo(file)
+
+		err = flockFile(file)
+		if errors.Is(err, errLockBusy) {
+			file.Close()
+			return nil, lockedError(path, prev)
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			// Без flock живой процесс определяется по PID на этой же машине
+			if prev != nil && prev.Host == host && prev.PID != os.Getpid() && pidAlive(prev.PID) {
+				file.Close()
+				return nil, lockedError(path, prev)
+			}
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		// Файл мог быть удалён и создан заново, пока ожидалась блокировка
+		if !sameLockFile(file, lockPath) {
+			file.Close()
+			continue
+		}
+
+		if prev != nil && prev.PID != 0 {
+			slog.Warn("Stale lock is taken over",
+				"Path", path,
+				"PID", prev.PID,
+				"Host", prev.Host)
+		}
+		info := LockInfo{PID: os.Getpid(), Host: host, Started: time.Now()}
+		err = writeLockInfo(file, &info)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &RootLock{path: path, file: file}, nil
+	}
+}
+
+// Снятие блокировки директории
+func (lock *RootLock) Unlock() error {
+	err := os.Remove(filepath.Join(lock.path, LockFile))
+	if closeErr := lock.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Ошибка занятой директории с информацией о процессе
+func lockedError(path string, info *LockInfo) error {
+	if info == nil || info.PID == 0 {
+		return fmt.Errorf("%s: %w", path, ErrLocked)
+	}
+	return fmt.Errorf("%s: %w (pid %d on %s since %s)", path, ErrLocked,
+		info.PID, info.Host, info.Started.Format(time.DateTime))
+}
+
+// Проверка, что открытый файл блокировки всё ещё лежит в директории
+func sameLockFile(file *os.File, lockPath string) bool {
+	opened, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(lockPath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current)
+}
+
+// Чтение информации о процессе из файла блокировки.
+// nil - файл пустой или повреждён
+func readLockInfo(file *os.File) (*LockInfo, error) {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	var info LockInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Запись информации о процессе в файл блокировки
+func writeLockInfo(file *os.File, info *LockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(append(data, '\n'), 0)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,28 @@
+package stream
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Блокировка уже занята другим процессом
+var errLockBusy = errors.New("lock is busy")
+
+// Взятие блокировки flock без ожидания
+func flockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch {
+	case errors.Is(err, syscall.EWOULDBLOCK):
+		return errLockBusy
+	case errors.Is(err, syscall.ENOLCK), errors.Is(err, syscall.EOPNOTSUPP):
+		return errors.ErrUnsupported
+	}
+	return err
+}
+
+// Проверка, что процесс с заданным PID существует
+func pidAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockRoot(t *testing.T) {
+	req := require.New(t)
+	path := t.TempDir()
+
+	lock, err := LockRoot(path)
+	req.NoError(err)
+	data, err := os.ReadFile(filepath.Join(path, LockFile))
+	req.NoError(err)
+	var info LockInfo
+	req.NoError(json.Unmarshal(data, &info))
+	req.Equal(os.Getpid(), info.PID)
+
+	// Занятая директория не блокируется повторно
+	_, err = LockRoot(path)
+	req.ErrorIs(err, ErrLocked)
+	req.ErrorContains(err, "pid")
+
+	req.NoError(lock.Unlock())
+	_, err = os.Stat(filepath.Join(path, LockFile))
+	req.ErrorIs(err, os.ErrNotExist)
+
+	// Блокировка, оставшаяся после аварийного завершения, перехватывается
+	stale, err := json.Marshal(LockInfo{PID: 1 << 30, Host: "crashed"})
+	req.NoError(err)
+	req.NoError(os.WriteFile(filepath.Join(path, LockFile), stale, 0644))
+	lock, err = LockRoot(path)
+	req.NoError(err)
+	defer lock.Unlock()
+	data, err = os.ReadFile(filepath.Join(path, LockFile))
+	req.NoError(err)
+	req.NoError(json.Unmarshal(data, &info))
+	req.Equal(os.Getpid(), info.PID)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package stream
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Блокировка уже занята другим процессом
+var errLockBusy = errors.New("lock is busy")
+
+// Блокировка flock на других системах не поддерживается
+func flockFile(file *os.File) error {
+	return errors.ErrUnsupported
+}
+
+// Проверка, что процесс с заданным PID существует. Если проверить
+// это невозможно, блокировка считается оставшейся после сбоя
+func pidAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,542 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Максимальное количество ссылок при разборе пути
+const memMaxLinks = 40
+
+// Файловая система в памяти, используемая в тестах
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+	// Имена вложенных файлов по полному имени директории
+	dirs map[string]map[string]struct{}
+	seq  int
+}
+
+// Файл, директория или ссылка в памяти
+type memNode struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+	target  string
+}
+
+// Информация о файле в памяти
+type memInfo struct {
+	name string
+	node *memNode
+	size int64
+	mode fs.FileMode
+	time time.Time
+}
+
+func (info *memInfo) Name() string       { return info.name }
+func (info *memInfo) Size() int64        { return info.size }
+func (info *memInfo) Mode() fs.FileMode  { return info.mode }
+func (info *memInfo) ModTime() time.Time { return info.time }
+func (info *memInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info *memInfo) Sys() any           { return info.node }
+
+// Файл в памяти, открытый для записи
+type memFile struct {
+	fsys *MemFS
+	name string
+	node *memNode
+}
+
+func (file *memFile) Write(data []byte) (int, error) {
+	file.fsys.mu.Lock()
+	defer file.fsys.mu.Unlock()
+	file.node.data = append(file.node.data, data...)
+	file.node.modTime = time.Now()
+	return len(data), nil
+}
+
+func (file *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	file.fsys.mu.Lock()
+	defer file.fsys.mu.Unlock()
+	if end := int(offset) + len(data); end > len(file.node.data) {
+		file.node.data = append(file.node.data, make([]byte, end-len(file.node.data))...)
+	}
+	copy(file.node.data[offset:], data)
+	file.node.modTime = time.Now()
+	return len(data), nil
+}
+
+func (file *memFile) Truncate(size int64) error {
+	file.fsys.mu.Lock()
+	defer file.fsys.mu.Unlock()
+	if int(size) > len(file.node.data) {
+		file.node.data = append(file.node.data, make([]byte, int(size)-len(file.node.data))...)
+	}
+	file.node.data = file.node.data[:size]
+	file.node.modTime = time.Now()
+	return nil
+}
+
+func (file *memFile) Name() string { return file.name }
+func (file *memFile) Sync() error  { return nil }
+func (file *memFile) Close() error { return nil }
+
+// Файл в памяти, открытый для чтения
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// Создание пустой файловой системы в памяти
+func NewMemFS() *MemFS {
+	return &MemFS{
+		nodes: map[string]*memNode{
+			"/": {mode: fs.ModeDir | 0755, modTime: time.Now()},
+		},
+		dirs: make(map[string]map[string]struct{}),
+	}
+}
+
+// Добавление файла вместе с записью в его родительской директории
+func (fsys *MemFS) put(full string, node *memNode) {
+	fsys.nodes[full] = node
+	parent := filepath.Dir(full)
+	if fsys.dirs[parent] == nil {
+		fsys.dirs[parent] = make(map[string]struct{})
+	}
+	fsys.dirs[parent][full] = struct{}{}
+}
+
+// Удаление файла вместе с записью в его родительской директории
+func (fsys *MemFS) drop(full string) {
+	delete(fsys.nodes, full)
+	delete(fsys.dirs, full)
+	parent := filepath.Dir(full)
+	delete(fsys.dirs[parent], full)
+	if len(fsys.dirs[parent]) == 0 {
+		delete(fsys.dirs, parent)
+	}
+}
+
+// Ошибка операции с файлом в памяти
+func memError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Разбор пути с переходом по ссылкам. Последняя часть пути
+// разбирается, только если задан followLast
+func (fsys *MemFS) realPath(name string, followLast bool, hops int) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return name, nil
+	}
+	parts := strings.Split(name[1:], "/")
+	cur := "/"
+	for i, part := range parts {
+		next := filepath.Join(cur, part)
+		node, ok := fsys.nodes[next]
+		last := i == len(parts)-1
+		if !ok {
+			if last {
+				return next, nil
+			}
+			return "", fs.ErrNotExist
+		}
+		if node.mode&fs.ModeSymlink != 0 && (!last || followLast) {
+			hops++
+			if hops > memMaxLinks {
+				return "", errors.New("too many links")
+			}
+			target := node.target
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(cur, target)
+			}
+			resolved, err := fsys.realPath(target, true, hops)
+			if err != nil {
+				return "", err
+			}
+			cur = resolved
+			continue
+		}
+		if !last && !node.mode.IsDir() {
+			return "", errors.New("not a directory")
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// Поиск файла по имени
+func (fsys *MemFS) find(op, name string, follow bool) (string, *memNode, error) {
+	full, err := fsys.realPath(name, follow, 0)
+	if err != nil {
+		return "", nil, memError(op, name, err)
+	}
+	node, ok := fsys.nodes[full]
+	if !ok {
+		return "", nil, memError(op, name, fs.ErrNotExist)
+	}
+	return full, node, nil
+}
+
+// Проверка, что новый файл можно создать, и получение его полного имени
+func (fsys *MemFS) create(op, name string) (string, error) {
+	full, err := fsys.realPath(name, false, 0)
+	if err != nil {
+		return "", memError(op, name, err)
+	}
+	if _, ok := fsys.nodes[full]; ok {
+		return "", memError(op, name, fs.ErrExist)
+	}
+	parent, ok := fsys.nodes[filepath.Dir(full)]
+	if !ok || !parent.mode.IsDir() {
+		return "", memError(op, name, fs.ErrNotExist)
+	}
+	return full, nil
+}
+
+// Обновление времени изменения директории после изменения её содержимого
+func (fsys *MemFS) touch(name string) {
+	if dir, ok := fsys.nodes[filepath.Dir(name)]; ok {
+		dir.modTime = time.Now()
+	}
+}
+
+// Получение имён вложенных файлов директории
+func (fsys *MemFS) children(dir string) []string {
+	names := make([]string, 0, len(fsys.dirs[dir]))
+	for name := range fsys.dirs[dir] {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Получение имён директории и всех вложенных в неё файлов
+func (fsys *MemFS) subtree(dir string) []string {
+	names := []string{dir}
+	for i := 0; i < len(names); i++ {
+		for name := range fsys.dirs[names[i]] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (fsys *MemFS) info(name string, node *memNode) *memInfo {
+	info := &memInfo{
+		name: filepath.Base(name),
+		node: node,
+		mode: node.mode,
+		time: node.modTime,
+	}
+	switch {
+	case node.mode&fs.ModeSymlink != 0:
+		info.size = int64(len(node.target))
+	case !node.mode.IsDir():
+		info.size = int64(len(node.data))
+	}
+	return info
+}
+
+func (fsys *MemFS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.info(name, node), nil
+}
+
+func (fsys *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.info(name, node), nil
+}
+
+func (fsys *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, node, err := fsys.find("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, memError("readdir", name, errors.New("not a directory"))
+	}
+	var entries []fs.DirEntry
+	for _, child := range fsys.children(full) {
+		entries = append(entries, fs.FileInfoToDirEntry(fsys.info(child, fsys.nodes[child])))
+	}
+	return entries, nil
+}
+
+func (fsys *MemFS) Readlink(name string) (string, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", memError("readlink", name, fs.ErrInvalid)
+	}
+	return node.target, nil
+}
+
+func (fsys *MemFS) Open(name string) (io.ReadCloser, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, memError("open", name, errors.New("is a directory"))
+	}
+	return memReader{bytes.NewReader(slices.Clone(node.data))}, nil
+}
+
+func (fsys *MemFS) OpenFile(name string) (File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, memError("open", name, errors.New("is a directory"))
+	}
+	return &memFile{fsys: fsys, name: name, node: node}, nil
+}
+
+func (fsys *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.seq++
+	name := filepath.Join(dir, strings.Replace(pattern, "*", strconv.Itoa(fsys.seq), 1))
+	if !strings.Contains(pattern, "*") {
+		name += strconv.Itoa(fsys.seq)
+	}
+	full, err := fsys.create("createtemp", name)
+	if err != nil {
+		return nil, err
+	}
+	node := &memNode{mode: 0600, modTime: time.Now()}
+	fsys.put(full, node)
+	fsys.touch(full)
+	return &memFile{fsys: fsys, name: name, node: node}, nil
+}
+
+func (fsys *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, err := fsys.create("mkdir", name)
+	if err != nil {
+		return err
+	}
+	fsys.put(full, &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()})
+	fsys.touch(full)
+	return nil
+}
+
+func (fsys *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	name = filepath.Clean("/" + name)
+	if info, err := fsys.Stat(name); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return memError("mkdir", name, errors.New("not a directory"))
+	}
+	if parent := filepath.Dir(name); parent != name {
+		err := fsys.MkdirAll(parent, perm)
+		if err != nil {
+			return err
+		}
+	}
+	err := fsys.Mkdir(name, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (fsys *MemFS) Symlink(target, name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, err := fsys.create("symlink", name)
+	if err != nil {
+		return err
+	}
+	fsys.put(full, &memNode{mode: fs.ModeSymlink | 0777, modTime: time.Now(), target: target})
+	fsys.touch(full)
+	return nil
+}
+
+func (fsys *MemFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, node, err := fsys.find("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() && len(fsys.children(full)) > 0 {
+		return memError("remove", name, errors.New("directory not empty"))
+	}
+	fsys.drop(full)
+	fsys.touch(full)
+	return nil
+}
+
+func (fsys *MemFS) RemoveAll(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, _, err := fsys.find("removeall", name, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, child := range fsys.subtree(full) {
+		fsys.drop(child)
+	}
+	fsys.touch(full)
+	return nil
+}
+
+func (fsys *MemFS) Rename(oldName, newName string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	oldReal, node, err := fsys.find("rename", oldName, false)
+	if err != nil {
+		return err
+	}
+	newReal, err := fsys.realPath(newName, false, 0)
+	if err != nil {
+		return memError("rename", newName, err)
+	}
+	if oldReal == newReal {
+		return nil
+	}
+	if strings.HasPrefix(newReal, oldReal+"/") {
+		return memError("rename", newName, fs.ErrInvalid)
+	}
+	if parent, ok := fsys.nodes[filepath.Dir(newReal)]; !ok || !parent.mode.IsDir() {
+		return memError("rename", newName, fs.ErrNotExist)
+	}
+	if old, ok := fsys.nodes[newReal]; ok {
+		if old.mode.IsDir() != node.mode.IsDir() {
+			return memError("rename", newName, fs.ErrExist)
+		}
+		if old.mode.IsDir() && len(fsys.children(newReal)) > 0 {
+			return memError("rename", newName, errors.New("directory not empty"))
+		}
+	}
+
+	moved := make(map[string]*memNode)
+	for _, child := range fsys.subtree(oldReal) {
+		moved[newReal+child[len(oldReal):]] = fsys.nodes[child]
+	}
+	for _, child := range fsys.subtree(oldReal) {
+		fsys.drop(child)
+	}
+	for child, childNode := range moved {
+		fsys.put(child, childNode)
+	}
+	fsys.touch(oldReal)
+	fsys.touch(newReal)
+	return nil
+}
+
+func (fsys *MemFS) Chmod(name string, mode fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode.Type() | mode&modeBits
+	return nil
+}
+
+func (fsys *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (fsys *MemFS) Lchtimes(name string, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("lchtimes", name, false)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// Запись файла целиком, используется для подготовки тестов
+func (fsys *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	full, err := fsys.realPath(name, true, 0)
+	if err != nil {
+		return memError("write", name, err)
+	}
+	if node, ok := fsys.nodes[full]; ok {
+		if node.mode.IsDir() {
+			return memError("write", name, errors.New("is a directory"))
+		}
+		node.data = slices.Clone(data)
+		node.modTime = time.Now()
+		return nil
+	}
+	full, err = fsys.create("write", name)
+	if err != nil {
+		return err
+	}
+	fsys.put(full, &memNode{mode: perm.Perm(), modTime: time.Now(), data: slices.Clone(data)})
+	fsys.touch(full)
+	return nil
+}
+
+func (fsys *MemFS) Link(oldName, newName string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.find("link", oldName, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() {
+		return memError("link", oldName, fs.ErrInvalid)
+	}
+	full, err := fsys.create("link", newName)
+	if err != nil {
+		return err
+	}
+	fsys.put(full, node)
+	fsys.touch(full)
+	return nil
+}
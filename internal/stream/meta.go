@@ -0,0 +1,304 @@
+package stream
+
+import (
+	"bytes"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Синхронизируемые биты режима файла: права доступа, setuid, setgid и sticky
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// Пространства имён расширенных атрибутов, сохраняемых с флагом Xattrs
+var xattrPrefixes = []string{"user.", "security.", "trusted."}
+
+// Префикс атрибутов, в которых хранятся POSIX ACL
+const aclPrefix = "system.posix_acl_"
+
+// Проверка, что расширенный атрибут сохраняется при заданных настройках
+func (opts *Options) keepXattr(attr string) bool {
+	if strings.HasPrefix(attr, aclPrefix) {
+		return opts.ACLs
+	}
+	if !opts.Xattrs {
+		return false
+	}
+	for _, prefix := range xattrPrefixes {
+		if strings.HasPrefix(attr, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверка, что расширенные атрибуты синхронизируются
+func (opts *Options) syncXattrs() bool {
+	return opts.Xattrs || opts.ACLs
+}
+
+// Закешированные расширенные атрибуты файла
+type metaInfo struct {
+	Ctime  int64
+	Xattrs map[string][]byte
+}
+
+// Запись владельца и расширенных атрибутов файла в информацию о нём.
+// Вызывается без блокировки буфера
+func (buf *BufInfo) readMeta(fullPath string, info os.FileInfo, fInfo *FileInfo) {
+	if uid, gid, ok := fileOwner(info); ok {
+		(*fInfo).Uid = uid
+		(*fInfo).Gid = gid
+	}
+	if !(*buf).opts.syncXattrs() || isLink(info) {
+		return
+	}
+	attrs, err := buf.fileXattrs(fullPath, info)
+	if err == nil && len(attrs) > 0 {
+		(*fInfo).Xattrs = attrs
+	}
+}
+
+// Проверка, что владелец файла отличается от сохранённого в буфере.
+// Владелец берётся из информации о файле без системных вызовов
+func (buf *BufInfo) ownerChanged(info os.FileInfo, fInfo *FileInfo) bool {
+	if !(*buf).opts.Owner {
+		return false
+	}
+	uid, gid, ok := fileOwner(info)
+	return ok && (uid != (*fInfo).Uid || gid != (*fInfo).Gid)
+}
+
+// Проверка, что владелец или расширенные атрибуты файла
+// отличаются от сохранённых в буфере
+func (buf *BufInfo) metaChanged(fullPath string, info os.FileInfo, fInfo *FileInfo) bool {
+	if buf.ownerChanged(info, fInfo) {
+		return true
+	}
+	if !(*buf).opts.syncXattrs() || isLink(info) {
+		return false
+	}
+	attrs, err := buf.fileXattrs(fullPath, info)
+	if err != nil {
+		return false
+	}
+	return !maps.EqualFunc(attrs, (*fInfo).Xattrs, bytes.Equal)
+}
+
+// Получение расширенных атрибутов файла из кеша, если ctime файла
+// не изменился с момента их чтения. Смена атрибутов меняет ctime
+func (buf *BufInfo) cachedXattrs(fullPath string, info os.FileInfo) (map[string][]byte, bool) {
+	ctime := changeTime(info)
+	if ctime == 0 {
+		return nil, false
+	}
+	(*buf).metaMu.Lock()
+	defer (*buf).metaMu.Unlock()
+	mInf, ok := (*buf).metas[fullPath]
+	if !ok || mInf.Ctime != ctime {
+		return nil, false
+	}
+	return mInf.Xattrs, true
+}
+
+// Получение расширенных атрибутов файла из кеша или их чтение,
+// если ctime файла изменился
+func (buf *BufInfo) fileXattrs(fullPath string, info os.FileInfo) (map[string][]byte, error) {
+	if attrs, ok := buf.cachedXattrs(fullPath, info); ok {
+		return attrs, nil
+	}
+	attrs, err := buf.readXattrs(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if ctime := changeTime(info); ctime != 0 {
+		(*buf).metaMu.Lock()
+		(*buf).metas[fullPath] = metaInfo{Ctime: ctime, Xattrs: attrs}
+		(*buf).metaMu.Unlock()
+	}
+	return attrs, nil
+}
+
+// Чтение расширенных атрибутов файла, если файловая система их поддерживает
+func (buf *BufInfo) readXattrs(fullPath string) (map[string][]byte, error) {
+	xfs, ok := buf.fsys().(XattrFS)
+	if !ok {
+		return nil, nil
+	}
+	return xfs.ReadXattrs(fullPath, (*buf).opts.keepXattr)
+}
+
+// Установка владельца и расширенных атрибутов файла из буфера
+func (buf *BufInfo) applyOwner(fullPath string, fInfo *FileInfo) error {
+	if ofs, ok := buf.fsys().(OwnerFS); ok && (*buf).opts.Owner {
+		err := ofs.Lchown(fullPath, (*fInfo).Uid, (*fInfo).Gid)
+		if err != nil {
+			return err
+		}
+	}
+	xfs, ok := buf.fsys().(XattrFS)
+	if !ok || !(*buf).opts.syncXattrs() || (*fInfo).IsLink {
+		return nil
+	}
+	return xfs.WriteXattrs(fullPath, (*fInfo).Xattrs, (*buf).opts.keepXattr)
+}
+
+// Применение прав доступа, времени изменения, владельца и расширенных
+// атрибутов из буфера к файлу, содержимое которого уже совпадает с файлом в буфере
+func (buf *BufInfo) applyMeta(fullPath string, fInfo *FileInfo) error {
+	err := buf.applyOwner(fullPath, fInfo)
+	if err != nil {
+		return err
+	}
+	if (*fInfo).IsLink {
+		return fsLchtimes(buf.fsys(), fullPath, (*fInfo).ModTime)
+	}
+	// Смена владельца сбрасывает биты setuid и setgid, поэтому права меняются после
+	err = buf.fsys().Chmod(fullPath, (*fInfo).Mode&modeBits)
+	if err != nil {
+		return err
+	}
+	return buf.fsys().Chtimes(fullPath, (*fInfo).ModTime, (*fInfo).ModTime)
+}
+
+// Синхронизация прав доступа, владельца и времени изменения директории.
+// Изменённые права и владелец берутся из директории, уже совпадавшей с буфером
+func (buf *BufInfo) updateDir(path, name string, info os.FileInfo, fInfo *FileInfo) {
+	fullPath := filepath.Join(path, name)
+	if info.Mode()&modeBits == (*fInfo).Mode&modeBits && !buf.metaChanged(fullPath, info, fInfo) {
+		if !info.ModTime().Equal((*fInfo).ModTime) {
+			buf.updateDirTime(path, name, info, fInfo)
+		}
+		return
+	}
+
+	if fInfo.findWhere(path) {
+		buf.buildInfo(name, path, &info)
+		slog.Info("Add in bufer",
+			"From", path,
+			"File", name)
+		return
+	}
+	if !buf.canRetry(path, name) {
+		return
+	}
+	err := buf.applyMeta(fullPath, fInfo)
+	if err != nil {
+		slog.Error("Metadata error",
+			"Path", path,
+			"File", name,
+			"Error", err)
+		buf.fileFailed(path, name, "meta", err)
+		return
+	}
+	buf.addWherePath(path, name)
+	buf.addStats(Stats{Meta: 1})
+	buf.fileDone(path, name)
+	slog.Info("Update file metadata",
+		"Path", path,
+		"File", name)
+}
+
+// Синхронизация времени изменения директории, отличающегося от буфера.
+// Время, изменённое в директории после её последней синхронизации,
+// записывается в буфер, даже если оно раньше времени в буфере.
+// Устаревшее время заменяется временем из буфера
+func (buf *BufInfo) updateDirTime(path, name string, info os.FileInfo, fInfo *FileInfo) {
+	ver, seen := (*fInfo).Seen[path]
+	if seen && !ver.ModTime.Equal(info.ModTime()) ||
+		!seen && info.ModTime().After((*fInfo).ModTime) {
+		buf.setModTime(path, name, info.ModTime())
+		return
+	}
+	if !buf.canRetry(path, name) {
+		return
+	}
+
+	fullPath := filepath.Join(path, name)
+	err := buf.fsys().Chtimes(fullPath, (*fInfo).ModTime, (*fInfo).ModTime)
+	if err != nil {
+		slog.Error("Metadata error",
+			"Path", path,
+			"File", name,
+			"Error", err)
+		buf.fileFailed(path, name, "meta", err)
+		return
+	}
+	buf.setModTime(path, name, (*fInfo).ModTime)
+}
+
+// Изменение времени изменения файла в буфере
+// и запись версии, которая теперь есть в директории path
+func (buf *BufInfo) setModTime(path, name string, modTime time.Time) {
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	fInfo, ok := (*buf).files[name]
+	if !ok {
+		return
+	}
+	if !(*fInfo).ModTime.Equal(modTime) {
+		(*fInfo).ModTime = modTime
+		buf.setTime(name)
+	}
+	if (*fInfo).Seen == nil {
+		(*fInfo).Seen = make(map[string]Version)
+	}
+	(*fInfo).Seen[path] = fInfo.version()
+}
+
+// Запись директории, в которой синхронизация создала,
+// удалила или переименовала файл name в текущем цикле
+func (buf *BufInfo) touchDir(path, name string) {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return
+	}
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	state, ok := (*buf).roots[path]
+	if !ok {
+		state = &rootState{}
+		(*buf).roots[path] = state
+	}
+	if state.touched == nil {
+		state.touched = make(map[string]struct{})
+	}
+	state.touched[dir] = struct{}{}
+}
+
+// Восстановление времени изменения директорий, которое поменялось
+// при создании и удалении вложенных файлов в текущем цикле синхронизации
+func (buf *BufInfo) syncDirTimes(path string) {
+	dirs := make(map[string]time.Time)
+	(*buf).mu.Lock()
+	if state, ok := (*buf).roots[path]; ok {
+		for name := range state.touched {
+			fInfo, ok := (*buf).files[name]
+			if ok && (*fInfo).IsDir && fInfo.findWhere(path) {
+				dirs[name] = (*fInfo).ModTime
+			}
+		}
+		state.touched = nil
+	}
+	(*buf).mu.Unlock()
+
+	for name, modTime := range dirs {
+		fullPath := filepath.Join(path, name)
+		info, err := buf.stat(fullPath)
+		if err != nil || !info.IsDir() || info.ModTime().Equal(modTime) {
+			continue
+		}
+		err = buf.fsys().Chtimes(fullPath, modTime, modTime)
+		if err != nil {
+			slog.Error("Metadata error",
+				"Path", path,
+				"File", name,
+				"Error", err)
+			buf.countError()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package stream
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Получение владельца и группы файла
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// Проверка, что файловая система не поддерживает расширенные атрибуты
+func noXattrs(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// Получение имён расширенных атрибутов файла
+func listXattrs(fullPath string) ([]string, error) {
+	size, err := syscall.Listxattr(fullPath, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	data := make([]byte, size)
+	size, err = syscall.Listxattr(fullPath, data)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(data[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Получение значения расширенного атрибута файла
+func getXattr(fullPath, attr string) ([]byte, error) {
+	size, err := syscall.Getxattr(fullPath, attr, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	size, err = syscall.Getxattr(fullPath, attr, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
+
+// Чтение расширенных атрибутов файла, отобранных функцией keep
+func readXattrs(fullPath string, keep func(string) bool) (map[string][]byte, error) {
+	names, err := listXattrs(fullPath)
+	if noXattrs(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string][]byte
+	for _, name := range names {
+		if !keep(name) {
+			continue
+		}
+		value, err := getXattr(fullPath, name)
+		if errors.Is(err, syscall.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs == nil {
+			attrs = make(map[string][]byte)
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// Установка расширенных атрибутов файла. Атрибуты, отобранные функцией keep,
+// но отсутствующие в attrs, удаляются
+func writeXattrs(fullPath string, attrs map[string][]byte, keep func(string) bool) error {
+	names, err := listXattrs(fullPath)
+	if noXattrs(err) && len(attrs) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := attrs[name]; ok || !keep(name) {
+			continue
+		}
+		err := syscall.Removexattr(fullPath, name)
+		if err != nil && !errors.Is(err, syscall.ENODATA) {
+			return err
+		}
+	}
+	for name, value := range attrs {
+		err := syscall.Setxattr(fullPath, name, value, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetaPreserve(t *testing.T) {
+	req := require.New(t)
+	if os.Getuid() != 0 {
+		t.Skip("changing owner needs root")
+	}
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	name0 := filepath.Join(paths[0], "text.txt")
+	name1 := filepath.Join(paths[1], "text.txt")
+
+	if err := syscall.Setxattr(name0, "user.test", []byte("one"), 0); err != nil {
+		t.Skip("extended attributes are not supported: ", err)
+	}
+	req.NoError(os.Chown(name0, 1234, 1234))
+
+	buf, err := SyncInfo(paths, Options{Owner: true, Xattrs: true})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	info, err := os.Stat(name1)
+	req.NoError(err)
+	uid, gid, _ := fileOwner(info)
+	req.Equal(1234, uid)
+	req.Equal(1234, gid)
+	value, err := getXattr(name1, "user.test")
+	req.NoError(err)
+	req.Equal("one", string(value))
+
+	// Изменение только атрибутов не копирует файл заново
+	ino := info.Sys().(*syscall.Stat_t).Ino
+	req.NoError(syscall.Setxattr(name0, "user.test", []byte("two"), 0))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	value, err = getXattr(name1, "user.test")
+	req.NoError(err)
+	req.Equal("two", string(value))
+	info, err = os.Stat(name1)
+	req.NoError(err)
+	req.Equal(ino, info.Sys().(*syscall.Stat_t).Ino)
+}
+
+func TestXattrCache(t *testing.T) {
+	req := require.New(t)
+	name := filepath.Join(t.TempDir(), "text.txt")
+	req.NoError(os.WriteFile(name, []byte("text"), 0644))
+	if err := syscall.Setxattr(name, "user.test", []byte("one"), 0); err != nil {
+		t.Skip("extended attributes are not supported: ", err)
+	}
+	buf := InitBufInfo()
+	(*buf).opts = Options{Xattrs: true}
+
+	info, err := os.Lstat(name)
+	req.NoError(err)
+	attrs, err := buf.fileXattrs(name, info)
+	req.NoError(err)
+	req.Equal("one", string(attrs["user.test"]))
+
+	// Пока ctime не изменился, атрибуты берутся из кеша
+	attrs, ok := buf.cachedXattrs(name, info)
+	req.True(ok)
+	req.Equal("one", string(attrs["user.test"]))
+
+	req.NoError(syscall.Setxattr(name, "user.test", []byte("two"), 0))
+	info, err = os.Lstat(name)
+	req.NoError(err)
+	_, ok = buf.cachedXattrs(name, info)
+	req.False(ok)
+	req.True(buf.metaChanged(name, info, &FileInfo{Xattrs: map[string][]byte{"user.test": []byte("one")}}))
+}
+
+func TestSpecialModeBits(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	dir0 := filepath.Join(paths[0], "shared")
+	name0 := filepath.Join(paths[0], "text.txt")
+	req.NoError(os.Mkdir(dir0, 0755))
+	req.NoError(os.Chmod(dir0, 0775|os.ModeSetgid|os.ModeSticky))
+	req.NoError(os.Chmod(name0, 0755|os.ModeSetgid))
+	modTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	req.NoError(os.Chtimes(name0, modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	info, err := os.Stat(filepath.Join(paths[1], "shared"))
+	req.NoError(err)
+	req.Equal(os.ModeDir|0775|os.ModeSetgid|os.ModeSticky, info.Mode())
+	info, err = os.Stat(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal(0755|os.ModeSetgid, info.Mode())
+
+	// Синхронизированная директория больше не считается изменённой
+	ig, err := LoadIgnore(buf.fsys(), paths[1], nil)
+	req.NoError(err)
+	entries, err := buf.scanPath(paths[1], ig)
+	req.NoError(err)
+	req.False(buf.comparePathInfo(paths[1], entries, ig))
+}
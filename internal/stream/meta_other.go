@@ -0,0 +1,20 @@
+//go:build !linux
+
+package stream
+
+import "os"
+
+// Получение владельца и группы файла. На других системах не поддерживается
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// Чтение расширенных атрибутов файла. На других системах не поддерживается
+func readXattrs(fullPath string, keep func(string) bool) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// Установка расширенных атрибутов файла. На других системах не поддерживается
+func writeXattrs(fullPath string, attrs map[string][]byte, keep func(string) bool) error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Файловая система, составленная из нескольких: файлы внутри
+// смонтированной директории обслуживаются её файловой системой,
+// остальные - файловой системой по умолчанию
+type MountFS struct {
+	def    FS
+	mounts map[string]FS
+}
+
+// Создание составной файловой системы
+func NewMountFS(def FS) *MountFS {
+	return &MountFS{def: def, mounts: make(map[string]FS)}
+}
+
+// Подключение файловой системы к директории
+func (mfs *MountFS) Mount(root string, fsys FS) {
+	mfs.mounts[root] = fsys
+}
+
+// Получение файловой системы, которая обслуживает файл
+func (mfs *MountFS) resolve(name string) FS {
+	best := ""
+	fsys := mfs.def
+	for root, mounted := range mfs.mounts {
+		if (name == root || strings.HasPrefix(name, root+"/")) && len(root) > len(best) {
+			best, fsys = root, mounted
+		}
+	}
+	return fsys
+}
+
+func (mfs *MountFS) Stat(name string) (fs.FileInfo, error) {
+	return mfs.resolve(name).Stat(name)
+}
+
+func (mfs *MountFS) Lstat(name string) (fs.FileInfo, error) {
+	return mfs.resolve(name).Lstat(name)
+}
+
+func (mfs *MountFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return mfs.resolve(name).ReadDir(name)
+}
+
+func (mfs *MountFS) Readlink(name string) (string, error) {
+	return mfs.resolve(name).Readlink(name)
+}
+
+func (mfs *MountFS) Open(name string) (io.ReadCloser, error) {
+	return mfs.resolve(name).Open(name)
+}
+
+func (mfs *MountFS) CreateTemp(dir, pattern string) (File, error) {
+	return mfs.resolve(dir).CreateTemp(dir, pattern)
+}
+
+func (mfs *MountFS) Mkdir(name string, perm fs.FileMode) error {
+	return mfs.resolve(name).Mkdir(name, perm)
+}
+
+func (mfs *MountFS) MkdirAll(name string, perm fs.FileMode) error {
+	return mfs.resolve(name).MkdirAll(name, perm)
+}
+
+func (mfs *MountFS) Symlink(target, name string) error {
+	return mfs.resolve(name).Symlink(target, name)
+}
+
+func (mfs *MountFS) Remove(name string) error {
+	return mfs.resolve(name).Remove(name)
+}
+
+func (mfs *MountFS) RemoveAll(name string) error {
+	return mfs.resolve(name).RemoveAll(name)
+}
+
+func (mfs *MountFS) Rename(oldName, newName string) error {
+	fsys := mfs.resolve(oldName)
+	if fsys != mfs.resolve(newName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: errors.ErrUnsupported}
+	}
+	return fsys.Rename(oldName, newName)
+}
+
+func (mfs *MountFS) Chmod(name string, mode fs.FileMode) error {
+	return mfs.resolve(name).Chmod(name, mode)
+}
+
+func (mfs *MountFS) Chtimes(name string, atime, mtime time.Time) error {
+	return mfs.resolve(name).Chtimes(name, atime, mtime)
+}
+
+func (mfs *MountFS) Lchtimes(name string, mtime time.Time) error {
+	return fsLchtimes(mfs.resolve(name), name, mtime)
+}
+
+func (mfs *MountFS) Lchown(name string, uid, gid int) error {
+	if ofs, ok := mfs.resolve(name).(OwnerFS); ok {
+		return ofs.Lchown(name, uid, gid)
+	}
+	return nil
+}
+
+func (mfs *MountFS) ReadXattrs(name string, keep func(string) bool) (map[string][]byte, error) {
+	if xfs, ok := mfs.resolve(name).(XattrFS); ok {
+		return xfs.ReadXattrs(name, keep)
+	}
+	return nil, nil
+}
+
+func (mfs *MountFS) WriteXattrs(name string, attrs map[string][]byte, keep func(string) bool) error {
+	if xfs, ok := mfs.resolve(name).(XattrFS); ok {
+		return xfs.WriteXattrs(name, attrs, keep)
+	}
+	return nil
+}
+
+func (mfs *MountFS) Link(oldName, newName string) error {
+	fsys := mfs.resolve(oldName)
+	lfs, ok := fsys.(LinkFS)
+	if !ok || fsys != mfs.resolve(newName) {
+		return &fs.PathError{Op: "link", Path: newName, Err: errors.ErrUnsupported}
+	}
+	return lfs.Link(oldName, newName)
+}
+
+func (mfs *MountFS) OpenFile(name string) (File, error) {
+	return fsOpenFile(mfs.resolve(name), name)
+}
+
+func (mfs *MountFS) SyncDir(name string) error {
+	fsSyncDir(mfs.resolve(name), name)
+	return nil
+}
+
+func (mfs *MountFS) Signature(name string, blockSize int) ([]BlockSum, error) {
+	return fsSignature(mfs.resolve(name), name, blockSize)
+}
+
+func (mfs *MountFS) Delta(name string, sums []BlockSum, blockSize int, emit func(op DeltaOp) error) error {
+	return fsDelta(mfs.resolve(name), name, sums, blockSize, emit)
+}
+
+func (mfs *MountFS) Clone(name, pattern string) (File, error) {
+	if cfs, ok := mfs.resolve(name).(CloneFS); ok {
+		return cfs.Clone(name, pattern)
+	}
+	return nil, &fs.PathError{Op: "clone", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Проверка, что директория находится на локальном диске
+func (buf *BufInfo) isLocal(path string) bool {
+	fsys := buf.fsys()
+	if mfs, ok := fsys.(*MountFS); ok {
+		fsys = mfs.resolve(path)
+	}
+	_, ok := fsys.(LocalFS)
+	return ok
+}
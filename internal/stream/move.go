@@ -0,0 +1,211 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Поиск переименованных файлов среди добавленных и удалённых за цикл.
+// Файл считается переименованным, если у нового имени тот же inode,
+// что был у старого в прошлом цикле, или совпадают размер и хеш.
+// При частичной синхронизации inodes дополняют известные идентификаторы
+func (buf *BufInfo) detectMoves(path string, added, removed []string, inodes map[fileID]string, partial bool) {
+	(*buf).mu.Lock()
+	prev := (*buf).inodes[path]
+	if partial && prev != nil {
+		old := make(map[fileID]string, len(inodes))
+		for key, name := range inodes {
+			if oldName, ok := prev[key]; ok {
+				old[key] = oldName
+			}
+			prev[key] = name
+		}
+		prev = old
+	} else {
+		(*buf).inodes[path] = inodes
+	}
+	(*buf).mu.Unlock()
+
+	if len(added) == 0 || len(removed) == 0 {
+		return
+	}
+	left := make(map[string]struct{}, len(removed))
+	bySize := make(map[int64][]string)
+	for _, name := range removed {
+		left[name] = struct{}{}
+		if fInfo := buf.TakeFileInfo(name); fInfo != nil &&
+			!(*fInfo).IsDir && !(*fInfo).IsLink {
+			bySize[(*fInfo).Size] = append(bySize[(*fInfo).Size], name)
+		}
+	}
+
+	for _, newName := range added {
+		info, err := buf.fsys().Lstat(filepath.Join(path, newName))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		oldName := ""
+		if key, ok := fileKey(info); ok {
+			if name, ok := prev[key]; ok {
+				if _, ok := left[name]; ok {
+					oldName = name
+				}
+			}
+		}
+		if oldName == "" {
+			oldName = buf.findSameContent(path, newName, info, bySize[info.Size()], left)
+		}
+		if oldName == "" {
+			continue
+		}
+
+		delete(left, oldName)
+		buf.setMoved(oldName, newName)
+		slog.Info("Move detected",
+			"Path", path,
+			"From", oldName,
+			"To", newName)
+	}
+}
+
+// Поиск среди удалённых файлов того же размера файла с тем же содержимым.
+// left содержит ещё не сопоставленные удалённые файлы
+func (buf *BufInfo) findSameContent(path, newName string, info os.FileInfo,
+	sameSize []string, left map[string]struct{}) string {
+	newHash := ""
+	for _, oldName := range sameSize {
+		if _, ok := left[oldName]; !ok {
+			continue
+		}
+		oldInf := buf.TakeFileInfo(oldName)
+		if oldInf == nil {
+			continue
+		}
+
+		if newHash == "" {
+			hash, err := buf.fileHash(filepath.Join(path, newName), info)
+			if err != nil {
+				return ""
+			}
+			newHash = hash
+		}
+		if buf.copyHash(oldName, oldInf) == newHash {
+			return oldName
+		}
+	}
+	return ""
+}
+
+// Получение хеша удалённого файла по одной из его копий в других директориях
+func (buf *BufInfo) copyHash(name string, fInfo *FileInfo) string {
+	if (*fInfo).Hash != "" {
+		return (*fInfo).Hash
+	}
+	for _, wherePath := range (*fInfo).Where {
+		fullPath := filepath.Join(wherePath, name)
+		info, err := buf.fsys().Lstat(fullPath)
+		if err != nil || !fInfo.compareInfo(&info) {
+			continue
+		}
+		hash, err := buf.fileHash(fullPath, info)
+		if err == nil {
+			return hash
+		}
+	}
+	return ""
+}
+
+// Запоминание нового имени удалённого файла
+func (buf *BufInfo) setMoved(oldName, newName string) {
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	if fInfo, ok := (*buf).files[oldName]; ok {
+		(*fInfo).MovedTo = newName
+	}
+}
+
+// Переименование файла в директории вслед за переименованием в другой
+// директории. Возвращает false, если файл нужно удалить и скопировать заново
+func (buf *BufInfo) moveFile(path, name string, info os.FileInfo, fInfo *FileInfo, ig *Ignore, ctx context.Context) bool {
+	newName := (*fInfo).MovedTo
+	newInf := buf.TakeFileInfo(newName)
+	if newInf == nil || buf.inTomb(newName) || ig.Match(newName, false) {
+		return false
+	}
+	if !info.Mode().IsRegular() || !fInfo.findWhere(path) ||
+		!fInfo.compareInfo(&info) || (*newInf).Size != info.Size() {
+		return false
+	}
+
+	fullPath := filepath.Join(path, name)
+	newPath := filepath.Join(path, newName)
+	if _, err := buf.fsys().Lstat(newPath); !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	buf.touchDir(path, name)
+	buf.touchDir(path, newName)
+	err := buf.buildParents(path, newName, ctx)
+	if err == nil {
+		err = buf.fsys().Rename(fullPath, newPath)
+	}
+	if err == nil && !newInf.compareInfo(&info) {
+		err = buf.applyMeta(newPath, newInf)
+	}
+	if err != nil {
+		slog.Error("Move error",
+			"Path", path,
+			"From", name,
+			"To", newName,
+			"Error", err)
+		return false
+	}
+
+	buf.dropHash(fullPath)
+	buf.eraseWherePath(path, name)
+	if tmp := buf.TakeFileInfo(name); tmp != nil && tmp.emptyInfo(path) {
+		buf.delFromBuf(name)
+	}
+	buf.addWherePath(path, newName)
+	buf.addStats(Stats{Moved: 1})
+	slog.Info("File moved",
+		"Path", path,
+		"From", name,
+		"To", newName)
+	return true
+}
+
+// Создание отсутствующих родительских директорий по образу из буфера
+func (buf *BufInfo) buildParents(path, name string, ctx context.Context) error {
+	var parents []string
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if _, err := buf.fsys().Lstat(filepath.Join(path, dir)); err == nil {
+			break
+		}
+		parents = append(parents, dir)
+	}
+
+	for i := len(parents) - 1; i >= 0; i-- {
+		dir := parents[i]
+		fInfo := buf.TakeFileInfo(dir)
+		if fInfo == nil || !(*fInfo).IsDir {
+			buf.touchDir(path, dir)
+			err := buf.fsys().Mkdir(filepath.Join(path, dir), 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := buf.BuildFile(path, dir, fInfo, ctx)
+		if err != nil {
+			return err
+		}
+		buf.addWherePath(path, dir)
+	}
+	return nil
+}
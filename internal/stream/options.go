@@ -0,0 +1,45 @@
+package stream
+
+import "time"
+
+// Настройки синхронизации
+type Options struct {
+	// Сравнение файлов по хешу содержимого, а не только по времени и размеру
+	Hash bool
+	// Способ разрешения конфликтов
+	Conflict ConflictPolicy
+	// Директория, побеждающая в конфликтах при способе ConflictPrefer
+	PreferDir string
+	// Проверка директорий с интервалом вместо отслеживания через inotify
+	Poll bool
+	// Общие для всех директорий шаблоны исключений в формате .gitignore
+	Ignore []string
+	// Способ обработки символических ссылок
+	Links LinkMode
+	// Перенос удалённых и перезаписанных файлов в директорию версий
+	Versions bool
+	// Количество хранимых версий файла, 0 - без ограничения
+	KeepVersions int
+	// Количество дней хранения версий, 0 - без ограничения
+	KeepDays int
+	// Максимальное количество файлов, удаляемых за цикл, 0 - без ограничения
+	MaxDelete int
+	// Максимальный процент файлов директории, удаляемых за цикл, 0 - без ограничения
+	MaxDeletePercent float64
+	// Отключение защиты от массового удаления
+	AllowMassDelete bool
+	// Сохранение владельца и группы файлов
+	Owner bool
+	// Сохранение расширенных атрибутов user.*, security.* и trusted.*
+	Xattrs bool
+	// Сохранение POSIX ACL
+	ACLs bool
+	// Количество неудачных попыток подряд, после которого файл
+	// помещается в карантин, 0 - без ограничения
+	MaxAttempts int
+	// Время, в течение которого размер и время изменения файла не должны
+	// меняться, прежде чем он будет скопирован, 0 - копировать сразу
+	Settle time.Duration
+	// Файловая система директорий, по умолчанию локальный диск
+	FS FS
+}
@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Пересечение синхронизируемых директорий
+type OverlapError struct {
+	// Директория, вызвавшая конфликт, и директория, с которой она пересекается
+	Path  string
+	Other string
+	// Path находится внутри Other, иначе это одна и та же директория
+	Nested bool
+	// Реальный путь Path после раскрытия символических ссылок
+	Real string
+}
+
+func (e *OverlapError) Error() string {
+	path := e.Path
+	if e.Real != "" && e.Real != filepath.Clean(e.Path) {
+		path += " (" + e.Real + ")"
+	}
+	if e.Nested {
+		return fmt.Sprintf("%s is inside %s, synchronisation would copy the directory into itself",
+			path, e.Other)
+	}
+	return fmt.Sprintf("%s and %s are the same directory", path, e.Other)
+}
+
+// Локальная директория с реальным путём и идентификатором
+type rootIdentity struct {
+	path  string
+	real  string
+	id    fileID
+	hasID bool
+	// Идентификаторы родительских директорий реального пути
+	parents []fileID
+}
+
+// Проверка, что локальные директории не совпадают и не вложены друг в друга,
+// в том числе через символические ссылки и повторное монтирование.
+// Удалённые директории проверяются сервером
+func CheckRoots(paths []string) error {
+	var roots []rootIdentity
+	for _, path := range paths {
+		if IsPeer(path) {
+			continue
+		}
+		root, err := identifyRoot(path)
+		if err != nil {
+			return err
+		}
+		for _, other := range roots {
+			if err := root.overlap(&other); err != nil {
+				return err
+			}
+		}
+		roots = append(roots, root)
+	}
+	return nil
+}
+
+// Получение реального пути и идентификаторов директории и её родителей
+func identifyRoot(path string) (rootIdentity, error) {
+	root := rootIdentity{path: path}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return root, err
+	}
+	root.real, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return root, err
+	}
+	info, err := os.Stat(root.real)
+	if err != nil {
+		return root, err
+	}
+	root.id, root.hasID = fileKey(info)
+	if !root.hasID {
+		return root, nil
+	}
+	for dir := filepath.Dir(root.real); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil {
+			if id, ok := fileKey(info); ok {
+				root.parents = append(root.parents, id)
+			}
+		}
+		if dir == filepath.Dir(dir) {
+			return root, nil
+		}
+	}
+}
+
+// Проверка пересечения с ранее проверенной директорией other
+func (root *rootIdentity) overlap(other *rootIdentity) error {
+	sameID := root.hasID && other.hasID && root.id == other.id
+	if root.real == other.real || sameID {
+		return &OverlapError{Path: root.path, Other: other.path, Real: root.real}
+	}
+	if pathInside(root.real, other.real) || root.hasParent(other) {
+		return &OverlapError{Path: root.path, Other: other.path, Nested: true, Real: root.real}
+	}
+	if pathInside(other.real, root.real) || other.hasParent(root) {
+		return &OverlapError{Path: other.path, Other: root.path, Nested: true, Real: other.real}
+	}
+	return nil
+}
+
+// Проверка, что директория other - один из родителей директории
+func (root *rootIdentity) hasParent(other *rootIdentity) bool {
+	if !other.hasID {
+		return false
+	}
+	for _, id := range root.parents {
+		if id == other.id {
+			return true
+		}
+	}
+	return false
+}
+
+// Проверка, что путь path находится внутри директории dir
+func pathInside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
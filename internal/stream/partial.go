@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Максимальная длина журнала изменений буфера. Директории, отставшие
+// больше чем на половину журнала, синхронизируются полным обходом
+const maxJournal = 1 << 16
+
+// Максимальное количество имён из событий, после которого
+// директория синхронизируется полным обходом
+const maxEventNames = 1 << 14
+
+// Запись имени изменённого в буфере файла в журнал.
+// Вызывается с уже захваченной блокировкой буфера
+func (buf *BufInfo) addJournal(name string) {
+	(*buf).journal = append((*buf).journal, name)
+	if len((*buf).journal) > maxJournal {
+		drop := len((*buf).journal) / 2
+		(*buf).journal = slices.Clone((*buf).journal[drop:])
+		(*buf).journalStart += uint64(drop)
+	}
+}
+
+// Получение имён файлов, изменённых в буфере после позиции pos журнала,
+// и новой позиции. false - часть изменений уже удалена из журнала
+func (buf *BufInfo) journalSince(pos uint64) ([]string, uint64, bool) {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	end := (*buf).journalStart + uint64(len((*buf).journal))
+	if pos < (*buf).journalStart {
+		return nil, end, false
+	}
+	return slices.Clone((*buf).journal[pos-(*buf).journalStart:]), end, true
+}
+
+// Получение имён файлов директории, которые ещё записываются
+// или операции с которыми пора повторить после ошибки
+func (buf *BufInfo) pendingNames(path string) []string {
+	var names []string
+	(*buf).settleMu.Lock()
+	for _, info := range (*buf).settling {
+		if info.path == path {
+			names = append(names, info.name)
+		}
+	}
+	(*buf).settleMu.Unlock()
+
+	now := time.Now()
+	(*buf).failMu.Lock()
+	for _, failure := range (*buf).failures {
+		if failure.Path == path && !failure.Quarantined && !now.Before(failure.Next) {
+			names = append(names, failure.Name)
+		}
+	}
+	(*buf).failMu.Unlock()
+	return names
+}
+
+// Синхронизация части директории: поддеревьев changed, в которых
+// произошли события, и отдельных файлов names, изменённых в буфере
+// или ожидающих повтора. Директория при этом целиком не обходится.
+// При изменении шаблонов исключений выполняется полная синхронизация
+func (buf *BufInfo) SyncNames(path string, changed, names []string, modTime *time.Time, ctx context.Context) error {
+	if slices.Contains(changed, IgnoreFile) {
+		return buf.SyncFiles(path, modTime, ctx)
+	}
+	if !buf.checkRoot(path) {
+		return nil
+	}
+
+	ig, err := LoadIgnore(buf.fsys(), path, (*buf).opts.Ignore)
+	if err != nil {
+		slog.Warn("Can't load ignore patterns",
+			"From path", path,
+			"Error", err)
+		buf.countError()
+		buf.setRootError(path, err)
+		return nil
+	}
+
+	buf.consumeRetry(path)
+	names = append(names, buf.pendingNames(path)...)
+	entries, missing, err := buf.scanNames(path, changed, names, ig)
+	if err != nil {
+		slog.Warn("Can't get file names",
+			"From path", path,
+			"Error", err)
+		buf.countError()
+		buf.setRootError(path, err)
+		return nil
+	}
+	buf.setRootError(path, nil)
+
+	inodes := make(map[fileID]string)
+	added := buf.updateFromPath(path, entries, ig, inodes, ctx)
+	if !buf.allowDeletes(path, missing, ig, inodes) {
+		return nil
+	}
+
+	removed := buf.updateFromBuf(path, missing, ig, ctx)
+	buf.dropStaleFailures(path)
+
+	buf.detectMoves(path, added, removed, inodes, true)
+	buf.syncDirTimes(path)
+	return nil
+}
+
+// Получение информации о файлах changed вместе с их поддеревьями и о файлах
+// names, а также отсортированных имён файлов буфера, которых среди них
+// нет в директории. Для поддеревьев удалённых директорий перебирается буфер
+func (buf *BufInfo) scanNames(path string, changed, names []string, ig *Ignore) ([]pathEntry, []string, error) {
+	var entries []pathEntry
+	var missing, gone []string
+	seen := make(map[string]struct{})
+
+	add := func(name string, subtree bool) error {
+		name = filepath.Clean(name)
+		if name == "." || !filepath.IsLocal(name) {
+			return nil
+		}
+		if _, ok := seen[name]; ok && !subtree {
+			return nil
+		}
+		seen[name] = struct{}{}
+
+		info, err := buf.stat(filepath.Join(path, name))
+		if err != nil || isLink(info) && (*buf).opts.Links == LinkSkip {
+			if !ig.Match(name, buf.bufIsDir(name)) {
+				missing = append(missing, name)
+				if subtree {
+					gone = append(gone, name)
+				}
+			}
+			return nil
+		}
+		if ig.Match(name, info.IsDir()) {
+			return nil
+		}
+		entries = append(entries, pathEntry{name: name, info: info})
+		if !subtree || !info.IsDir() {
+			return nil
+		}
+		return walkSubdir(buf.fsys(), path, name, ig, (*buf).opts.Links,
+			func(name string, info os.FileInfo) error {
+				seen[name] = struct{}{}
+				entries = append(entries, pathEntry{name: name, info: info})
+				return nil
+			})
+	}
+
+	for _, name := range changed {
+		// Время изменения родительской директории меняется вместе с её содержимым
+		if err := add(filepath.Dir(name), false); err != nil {
+			return nil, nil, err
+		}
+		if err := add(name, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, name := range names {
+		if err := add(name, false); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(gone) > 0 {
+		missing = append(missing, buf.bufSubtrees(gone, seen, ig)...)
+	}
+
+	slices.SortFunc(entries, func(a, b pathEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+	entries = slices.CompactFunc(entries, func(a, b pathEntry) bool {
+		return a.name == b.name
+	})
+	slices.Sort(missing)
+	missing = slices.Compact(missing)
+	return entries, missing, nil
+}
+
+// Проверка, что файл в буфере является директорией
+func (buf *BufInfo) bufIsDir(name string) bool {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	fInfo, ok := (*buf).files[name]
+	return ok && (*fInfo).IsDir
+}
+
+// Получение имён файлов буфера, вложенных в удалённые директории dirs,
+// кроме уже найденных в директории и исключённых
+func (buf *BufInfo) bufSubtrees(dirs []string, seen map[string]struct{}, ig *Ignore) []string {
+	var names []string
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	for name, fInfo := range (*buf).files {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		for _, dir := range dirs {
+			if strings.HasPrefix(name, dir+string(filepath.Separator)) {
+				if !ig.Match(name, (*fInfo).IsDir) {
+					names = append(names, name)
+				}
+				break
+			}
+		}
+	}
+	return names
+}
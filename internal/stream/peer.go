@@ -0,0 +1,585 @@
+package stream
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Схема адреса удалённой директории peer://host:port/name
+const PeerScheme = "peer://"
+
+// Размер блока, запрашиваемого или отправляемого за один запрос
+const peerBlockSize = 1 << 20
+
+// Время ожидания подключения к удалённой директории
+const peerDialTimeout = 10 * time.Second
+
+// Время ожидания ответа на один запрос. Сервер, который не ответил,
+// считается недоступным, и соединение открывается заново
+const peerTimeout = time.Minute
+
+// Максимальный размер запроса подтверждения доступа
+const maxPeerAuth = 4096
+
+// Коды ошибок протокола, по которым восстанавливаются ошибки fs
+const (
+	peerErrOther = iota + 1
+	peerErrNotExist
+	peerErrExist
+	peerErrInvalid
+	peerErrUnsupported
+	peerErrPermission
+)
+
+// Первый запрос клиента, подтверждающий доступ общим с сервером ключом
+type peerAuthRequest struct {
+	Token string
+}
+
+// Запрос к удалённой директории
+type peerRequest struct {
+	// Операция: stat, lstat, readdir, readlink, read, create, write, sync,
+	// mkdir, mkdirall, symlink, remove, removeall, rename, chmod, chtimes,
+	// lchtimes, link, syncdir, signature, delta, clone, truncate, copyrange
+	Op string
+	// Имя директории на сервере
+	Root string
+	// Имена файлов относительно директории
+	Name    string
+	NewName string
+	Mode    fs.FileMode
+	Time    time.Time
+	Offset  int64
+	From    int64 // Смещение в файле NewName, откуда копируется участок
+	Size    int
+	Data    []byte
+	// Сигнатура передаётся только в первом запросе delta,
+	// сервер хранит её до конца передачи с номером Delta
+	Sums  []BlockSum
+	Delta uint64
+}
+
+// Ответ удалённой директории
+type peerResponse struct {
+	Code  int
+	Err   string
+	Info  peerInfo
+	Infos []peerInfo
+	Name  string
+	Data  []byte
+	EOF   bool
+	Sums  []BlockSum
+	Ops   []DeltaOp
+}
+
+// Информация о файле, передаваемая по сети
+type peerInfo struct {
+	FileName string
+	FileSize int64
+	FileMode fs.FileMode
+	Time     time.Time
+	ID       fileID
+}
+
+func (info *peerInfo) Name() string       { return info.FileName }
+func (info *peerInfo) Size() int64        { return info.FileSize }
+func (info *peerInfo) Mode() fs.FileMode  { return info.FileMode }
+func (info *peerInfo) ModTime() time.Time { return info.Time }
+func (info *peerInfo) IsDir() bool        { return info.FileMode.IsDir() }
+func (info *peerInfo) Sys() any           { return info.ID }
+
+// Проверка, что директория находится на другой машине
+func IsPeer(root string) bool {
+	return strings.HasPrefix(root, PeerScheme) || strings.HasPrefix(root, "peer:/")
+}
+
+// Разбор адреса удалённой директории. Возвращает адрес сервера, имя
+// директории на сервере и путь, используемый как имя директории при синхронизации
+func ParsePeer(root string) (addr, name, path string, err error) {
+	rest, ok := strings.CutPrefix(root, PeerScheme)
+	if !ok {
+		rest, ok = strings.CutPrefix(root, "peer:/")
+	}
+	if !ok {
+		return "", "", "", fmt.Errorf("%s is not a peer address", root)
+	}
+	addr, name, ok = strings.Cut(rest, "/")
+	name = strings.Trim(name, "/")
+	if !ok || addr == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", "", fmt.Errorf("peer address %s must look like %shost:port/name", root, PeerScheme)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", "", fmt.Errorf("peer address %s: %w", root, err)
+	}
+	// filepath.Join схлопывает "//", поэтому путь сразу приводится к такому виду
+	return addr, name, filepath.Clean(PeerScheme + addr + "/" + name), nil
+}
+
+// Файловые системы для директорий группы: удалённые директории
+// обслуживаются по сети, остальные - локальным диском.
+// Возвращает пути директорий, используемые при синхронизации
+func RootsFS(roots []string, token string) (FS, []string, error) {
+	paths := make([]string, 0, len(roots))
+	var mfs *MountFS
+	for _, root := range roots {
+		if !IsPeer(root) {
+			paths = append(paths, root)
+			continue
+		}
+		addr, name, path, err := ParsePeer(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mfs == nil {
+			mfs = NewMountFS(LocalFS{})
+		}
+		mfs.Mount(path, NewPeerFS(addr, name, path, token))
+		paths = append(paths, path)
+	}
+	if mfs == nil {
+		return LocalFS{}, paths, nil
+	}
+	return mfs, paths, nil
+}
+
+// Клиент удалённой директории. Запросы выполняются по одному соединению
+// по очереди, при ошибке сети соединение открывается заново
+type PeerFS struct {
+	addr   string
+	root   string
+	prefix string
+	token  string
+
+	// Время ожидания ответа на запрос
+	timeout time.Duration
+
+	mu   sync.Mutex
+	seq  atomic.Uint64
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// Создание клиента директории root на сервере addr.
+// Файлы клиента имеют имена вида prefix/имя.
+// token - общий с сервером ключ, которым клиент подтверждает доступ
+func NewPeerFS(addr, root, prefix, token string) *PeerFS {
+	return &PeerFS{addr: addr, root: root, prefix: prefix, token: token, timeout: peerTimeout}
+}
+
+// Получение имени файла относительно директории на сервере
+func (pfs *PeerFS) rel(name string) (string, error) {
+	if name == pfs.prefix {
+		return ".", nil
+	}
+	rel, ok := strings.CutPrefix(name, pfs.prefix+"/")
+	if !ok {
+		return "", &fs.PathError{Op: "peer", Path: name, Err: fs.ErrInvalid}
+	}
+	return rel, nil
+}
+
+// Выполнение запроса к серверу. Если сервер не ответил за время
+// ожидания, запрос завершается ошибкой os.ErrDeadlineExceeded
+func (pfs *PeerFS) call(req peerRequest) (*peerResponse, error) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+
+	req.Root = pfs.root
+	if pfs.conn == nil {
+		conn, err := net.DialTimeout("tcp", pfs.addr, peerDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		err = pfs.auth(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		pfs.conn = conn
+		pfs.enc = gob.NewEncoder(conn)
+		pfs.dec = gob.NewDecoder(conn)
+	}
+
+	var resp peerResponse
+	err := pfs.conn.SetDeadline(time.Now().Add(pfs.timeout))
+	if err == nil {
+		err = pfs.enc.Encode(&req)
+	}
+	if err == nil {
+		err = pfs.dec.Decode(&resp)
+	}
+	if err != nil {
+		pfs.conn.Close()
+		pfs.conn = nil
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Подтверждение доступа к серверу после подключения.
+// Запрос кодируется отдельно от остальных, чтобы сервер мог
+// ограничить его размер до проверки ключа
+func (pfs *PeerFS) auth(conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(pfs.timeout))
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(conn).Encode(&peerAuthRequest{Token: pfs.token})
+	if err != nil {
+		return err
+	}
+	var resp peerResponse
+	err = gob.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return peerError(resp.Code, resp.Err)
+	}
+	return nil
+}
+
+// Выполнение запроса с файлом и восстановление ошибки fs из ответа
+func (pfs *PeerFS) do(op, name string, req peerRequest) (*peerResponse, error) {
+	rel, err := pfs.rel(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Op = op
+	req.Name = rel
+	resp, err := pfs.call(req)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if resp.Code != 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: peerError(resp.Code, resp.Err)}
+	}
+	return resp, nil
+}
+
+// Восстановление ошибки по коду из ответа
+func peerError(code int, msg string) error {
+	var base error
+	switch code {
+	case peerErrNotExist:
+		base = fs.ErrNotExist
+	case peerErrExist:
+		base = fs.ErrExist
+	case peerErrInvalid:
+		base = fs.ErrInvalid
+	case peerErrUnsupported:
+		base = errors.ErrUnsupported
+	case peerErrPermission:
+		base = fs.ErrPermission
+	default:
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s: %w", msg, base)
+}
+
+func (pfs *PeerFS) Stat(name string) (fs.FileInfo, error) {
+	resp, err := pfs.do("stat", name, peerRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Info, nil
+}
+
+func (pfs *PeerFS) Lstat(name string) (fs.FileInfo, error) {
+	resp, err := pfs.do("lstat", name, peerRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Info, nil
+}
+
+// Чтение директории. Вместе с именами передаётся информация
+// о файлах, поэтому обход директории не требует отдельных запросов
+func (pfs *PeerFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resp, err := pfs.do("readdir", name, peerRequest{})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(resp.Infos))
+	for i := range resp.Infos {
+		entries = append(entries, fs.FileInfoToDirEntry(&resp.Infos[i]))
+	}
+	return entries, nil
+}
+
+func (pfs *PeerFS) Readlink(name string) (string, error) {
+	resp, err := pfs.do("readlink", name, peerRequest{})
+	if err != nil {
+		return "", err
+	}
+	return resp.Name, nil
+}
+
+// Открытие файла для чтения. Содержимое запрашивается блоками по мере чтения
+func (pfs *PeerFS) Open(name string) (io.ReadCloser, error) {
+	info, err := pfs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return &peerReader{fsys: pfs, name: name}, nil
+}
+
+func (pfs *PeerFS) CreateTemp(dir, pattern string) (File, error) {
+	resp, err := pfs.do("create", dir, peerRequest{NewName: pattern})
+	if err != nil {
+		return nil, err
+	}
+	return &peerWriter{fsys: pfs, name: filepath.Join(dir, resp.Name)}, nil
+}
+
+func (pfs *PeerFS) Mkdir(name string, perm fs.FileMode) error {
+	_, err := pfs.do("mkdir", name, peerRequest{Mode: perm})
+	return err
+}
+
+func (pfs *PeerFS) MkdirAll(name string, perm fs.FileMode) error {
+	_, err := pfs.do("mkdirall", name, peerRequest{Mode: perm})
+	return err
+}
+
+func (pfs *PeerFS) Symlink(target, name string) error {
+	_, err := pfs.do("symlink", name, peerRequest{NewName: target})
+	return err
+}
+
+func (pfs *PeerFS) Remove(name string) error {
+	_, err := pfs.do("remove", name, peerRequest{})
+	return err
+}
+
+func (pfs *PeerFS) RemoveAll(name string) error {
+	_, err := pfs.do("removeall", name, peerRequest{})
+	return err
+}
+
+func (pfs *PeerFS) Rename(oldName, newName string) error {
+	rel, err := pfs.rel(newName)
+	if err != nil {
+		return err
+	}
+	_, err = pfs.do("rename", oldName, peerRequest{NewName: rel})
+	return err
+}
+
+func (pfs *PeerFS) Chmod(name string, mode fs.FileMode) error {
+	_, err := pfs.do("chmod", name, peerRequest{Mode: mode})
+	return err
+}
+
+func (pfs *PeerFS) Chtimes(name string, atime, mtime time.Time) error {
+	_, err := pfs.do("chtimes", name, peerRequest{Time: mtime})
+	return err
+}
+
+func (pfs *PeerFS) Lchtimes(name string, mtime time.Time) error {
+	_, err := pfs.do("lchtimes", name, peerRequest{Time: mtime})
+	return err
+}
+
+func (pfs *PeerFS) Link(oldName, newName string) error {
+	rel, err := pfs.rel(newName)
+	if err != nil {
+		return err
+	}
+	_, err = pfs.do("link", oldName, peerRequest{NewName: rel})
+	return err
+}
+
+func (pfs *PeerFS) SyncDir(name string) error {
+	_, err := pfs.do("syncdir", name, peerRequest{})
+	return err
+}
+
+// Вычисление сигнатуры файла на сервере
+func (pfs *PeerFS) Signature(name string, blockSize int) ([]BlockSum, error) {
+	resp, err := pfs.do("signature", name, peerRequest{Size: blockSize})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Sums, nil
+}
+
+// Вычисление разницы файла с сигнатурой на сервере. Сервер отвечает
+// частями, каждая следующая запрашивается с конца предыдущей.
+// Сигнатура отправляется один раз, с запросом первой части
+func (pfs *PeerFS) Delta(name string, sums []BlockSum, blockSize int, emit func(op DeltaOp) error) error {
+	id := pfs.seq.Add(1)
+	var offset int64
+	for first := true; ; first = false {
+		req := peerRequest{Offset: offset, Size: blockSize, Delta: id}
+		if first {
+			req.Sums = sums
+		}
+		resp, err := pfs.do("delta", name, req)
+		if err != nil {
+			return err
+		}
+		for _, op := range resp.Ops {
+			err := emit(op)
+			if err != nil {
+				return err
+			}
+			if len(op.Data) > 0 {
+				offset = op.Offset + int64(len(op.Data))
+			} else {
+				offset = op.Offset + int64(blockSize)
+			}
+		}
+		if resp.EOF {
+			return nil
+		}
+	}
+}
+
+// Создание временной копии файла на сервере
+func (pfs *PeerFS) Clone(name, pattern string) (File, error) {
+	resp, err := pfs.do("clone", name, peerRequest{NewName: pattern})
+	if err != nil {
+		return nil, err
+	}
+	return &peerWriter{fsys: pfs, name: filepath.Join(filepath.Dir(name), resp.Name)}, nil
+}
+
+// Чтение удалённого файла блоками
+type peerReader struct {
+	fsys   *PeerFS
+	name   string
+	offset int64
+	data   []byte
+	eof    bool
+}
+
+func (reader *peerReader) Read(data []byte) (int, error) {
+	if len(reader.data) == 0 {
+		if reader.eof {
+			return 0, io.EOF
+		}
+		resp, err := reader.fsys.do("read", reader.name,
+			peerRequest{Offset: reader.offset, Size: peerBlockSize})
+		if err != nil {
+			return 0, err
+		}
+		reader.data = resp.Data
+		reader.offset += int64(len(resp.Data))
+		reader.eof = resp.EOF
+		if len(reader.data) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(data, reader.data)
+	reader.data = reader.data[n:]
+	return n, nil
+}
+
+func (reader *peerReader) Close() error {
+	return nil
+}
+
+// Запись удалённого файла. Данные отправляются блоками
+type peerWriter struct {
+	fsys   *PeerFS
+	name   string
+	offset int64
+	data   []byte
+}
+
+func (writer *peerWriter) Write(data []byte) (int, error) {
+	writer.data = append(writer.data, data...)
+	if len(writer.data) >= peerBlockSize {
+		if err := writer.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Запись с произвольного места. Данные отправляются сразу
+func (writer *peerWriter) WriteAt(data []byte, offset int64) (int, error) {
+	err := writer.flush()
+	if err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(data); n += peerBlockSize {
+		block := data[n:min(n+peerBlockSize, len(data))]
+		_, err := writer.fsys.do("write", writer.name,
+			peerRequest{Offset: offset + int64(n), Data: block})
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(data), nil
+}
+
+// Копирование участка другого файла на сервере
+func (writer *peerWriter) CopyRange(src string, from, to int64, size int) error {
+	err := writer.flush()
+	if err != nil {
+		return err
+	}
+	rel, err := writer.fsys.rel(src)
+	if err != nil {
+		return err
+	}
+	_, err = writer.fsys.do("copyrange", writer.name,
+		peerRequest{NewName: rel, From: from, Offset: to, Size: size})
+	return err
+}
+
+func (writer *peerWriter) Truncate(size int64) error {
+	err := writer.flush()
+	if err != nil {
+		return err
+	}
+	_, err = writer.fsys.do("truncate", writer.name, peerRequest{Offset: size})
+	return err
+}
+
+// Отправка накопленных данных на сервер
+func (writer *peerWriter) flush() error {
+	if len(writer.data) == 0 {
+		return nil
+	}
+	_, err := writer.fsys.do("write", writer.name,
+		peerRequest{Offset: writer.offset, Data: writer.data})
+	if err != nil {
+		return err
+	}
+	writer.offset += int64(len(writer.data))
+	writer.data = writer.data[:0]
+	return nil
+}
+
+func (writer *peerWriter) Name() string {
+	return writer.name
+}
+
+func (writer *peerWriter) Sync() error {
+	err := writer.flush()
+	if err != nil {
+		return err
+	}
+	_, err = writer.fsys.do("sync", writer.name, peerRequest{})
+	return err
+}
+
+func (writer *peerWriter) Close() error {
+	return writer.flush()
+}
@@ -0,0 +1,482 @@
+package stream
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Обслуживание директорий файловой системы fsys по сети до завершения
+// контекста. roots содержит пути директорий по их именам. Запросы
+// принимаются только от клиентов, передавших общий ключ token
+func Serve(ln net.Listener, fsys FS, roots map[string]string, token string, ctx context.Context) error {
+	if token == "" {
+		return errors.New("peer token is not set")
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveConn(conn, fsys, roots, token)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// Обработка запросов одного клиента
+func serveConn(conn net.Conn, fsys FS, roots map[string]string, token string) {
+	defer conn.Close()
+	slog.Info("Peer connected", "Addr", conn.RemoteAddr())
+
+	if !peerAuth(conn, token) {
+		slog.Warn("Peer is not authorized", "Addr", conn.RemoteAddr())
+		return
+	}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	deltas := make(map[uint64][]BlockSum)
+	for {
+		var req peerRequest
+		err := dec.Decode(&req)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Peer request error",
+					"Addr", conn.RemoteAddr(),
+					"Error", err)
+			}
+			slog.Info("Peer disconnected", "Addr", conn.RemoteAddr())
+			return
+		}
+
+		resp := handlePeer(&req, fsys, roots, deltas)
+		err = enc.Encode(resp)
+		if err != nil {
+			slog.Warn("Peer response error",
+				"Addr", conn.RemoteAddr(),
+				"Error", err)
+			return
+		}
+	}
+}
+
+// Проверка ключа из первого запроса клиента. Размер запроса и время
+// его ожидания ограничены, чтобы клиент без ключа не занимал память сервера
+func peerAuth(conn net.Conn, token string) bool {
+	if conn.SetDeadline(time.Now().Add(peerTimeout)) != nil {
+		return false
+	}
+	var req peerAuthRequest
+	if gob.NewDecoder(io.LimitReader(conn, maxPeerAuth)).Decode(&req) != nil {
+		return false
+	}
+	resp := &peerResponse{}
+	ok := subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) == 1
+	if !ok {
+		peerFail(resp, fmt.Errorf("peer is not authorized: %w", fs.ErrPermission))
+	}
+	if gob.NewEncoder(conn).Encode(resp) != nil || !ok {
+		return false
+	}
+	// Между запросами клиент может долго не обращаться к серверу
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+// Максимальное количество символических ссылок, разрешаемых в одном пути
+const maxPeerLinks = 40
+
+// Получение полного пути файла внутри обслуживаемой директории.
+// Символические ссылки в пути разрешаются по одной, и путь, ведущий
+// за пределы директории, отклоняется. Последняя ссылка пути
+// разрешается только при follow, иначе операция выполняется с ней самой
+func peerPath(fsys FS, root, name string, follow bool) (string, error) {
+	rest := splitPath(filepath.Clean("/" + name))
+	cur := root
+	links := 0
+	for len(rest) > 0 {
+		next := filepath.Join(cur, rest[0])
+		rest = rest[1:]
+		if len(rest) == 0 && !follow {
+			return next, nil
+		}
+		info, err := fsys.Lstat(next)
+		if err != nil {
+			// Внутри несуществующей директории ссылок нет
+			return filepath.Join(append([]string{next}, rest...)...), nil
+		}
+		if !isLink(info) {
+			cur = next
+			continue
+		}
+
+		links++
+		if links > maxPeerLinks {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: errors.New("too many links")}
+		}
+		target, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(cur, target)
+		}
+		rel, err := filepath.Rel(root, filepath.Clean(target))
+		if err != nil || !filepath.IsLocal(rel) && rel != "." {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: fs.ErrPermission}
+		}
+		rest = append(splitPath(rel), rest...)
+		cur = root
+	}
+	return cur, nil
+}
+
+// Разбиение относительного пути на элементы без пустых и "."
+func splitPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Получение информации о файле для передачи по сети
+func makePeerInfo(info os.FileInfo) peerInfo {
+	id, _ := fileKey(info)
+	return peerInfo{
+		FileName: info.Name(),
+		FileSize: info.Size(),
+		FileMode: info.Mode(),
+		Time:     info.ModTime(),
+		ID:       id,
+	}
+}
+
+// Выполнение запроса к локальной директории.
+// deltas хранит сигнатуры незавершённых передач разницы клиента
+func handlePeer(req *peerRequest, fsys FS, roots map[string]string, deltas map[uint64][]BlockSum) *peerResponse {
+	resp := &peerResponse{}
+	root, ok := roots[req.Root]
+	if !ok {
+		return peerFail(resp, fmt.Errorf("unknown directory %q: %w", req.Root, fs.ErrNotExist))
+	}
+	// Операции, которые выполняются с самой ссылкой, а не с её целью
+	follow := true
+	switch req.Op {
+	case "lstat", "readlink", "symlink", "remove", "removeall", "rename", "lchtimes", "link", "mkdir":
+		follow = false
+	}
+	name, err := peerPath(fsys, root, req.Name, follow)
+	if err != nil {
+		return peerFail(resp, err)
+	}
+	var newName string
+	switch req.Op {
+	case "rename", "link", "copyrange":
+		newName, err = peerPath(fsys, root, req.NewName, req.Op == "copyrange")
+	case "create", "clone":
+		// Шаблон имени временного файла не может указывать на другую директорию
+		if strings.ContainsRune(req.NewName, filepath.Separator) {
+			err = fmt.Errorf("temporary file pattern %q: %w", req.NewName, fs.ErrInvalid)
+		}
+	}
+	if err != nil {
+		return peerFail(resp, err)
+	}
+
+	switch req.Op {
+	case "stat", "lstat":
+		var info os.FileInfo
+		if req.Op == "stat" {
+			info, err = fsys.Stat(name)
+		} else {
+			info, err = fsys.Lstat(name)
+		}
+		if err == nil {
+			resp.Info = makePeerInfo(info)
+		}
+	case "readdir":
+		var entries []fs.DirEntry
+		entries, err = fsys.ReadDir(name)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			resp.Infos = append(resp.Infos, makePeerInfo(info))
+		}
+	case "readlink":
+		resp.Name, err = fsys.Readlink(name)
+	case "read":
+		resp.Data, resp.EOF, err = readBlock(fsys, name, req.Offset, req.Size)
+	case "create":
+		var file File
+		file, err = fsys.CreateTemp(name, req.NewName)
+		if err == nil {
+			resp.Name = filepath.Base(file.Name())
+			err = file.Close()
+		}
+	case "write":
+		err = writeBlock(fsys, name, req.Offset, req.Data)
+	case "sync":
+		var file File
+		file, err = fsOpenFile(fsys, name)
+		if err == nil {
+			err = file.Sync()
+			file.Close()
+		}
+	case "mkdir":
+		err = fsys.Mkdir(name, req.Mode)
+	case "mkdirall":
+		err = fsys.MkdirAll(name, req.Mode)
+	case "symlink":
+		// Цель ссылки передаётся как есть
+		err = fsys.Symlink(req.NewName, name)
+	case "remove":
+		err = fsys.Remove(name)
+	case "removeall":
+		if name == root {
+			err = fs.ErrInvalid
+		} else {
+			err = fsys.RemoveAll(name)
+		}
+	case "rename":
+		err = fsys.Rename(name, newName)
+	case "chmod":
+		err = fsys.Chmod(name, req.Mode)
+	case "chtimes":
+		err = fsys.Chtimes(name, req.Time, req.Time)
+	case "lchtimes":
+		err = fsLchtimes(fsys, name, req.Time)
+	case "link":
+		if lfs, ok := fsys.(LinkFS); ok {
+			err = lfs.Link(name, newName)
+		} else {
+			err = errors.ErrUnsupported
+		}
+	case "syncdir":
+		if sfs, ok := fsys.(SyncDirFS); ok {
+			err = sfs.SyncDir(name)
+		}
+	case "signature":
+		err = checkBlockSize(req.Size)
+		if err == nil {
+			resp.Sums, err = fsSignature(fsys, name, req.Size)
+		}
+	case "delta":
+		var sums []BlockSum
+		sums, err = deltaSums(deltas, req)
+		if err == nil {
+			resp.Ops, resp.EOF, err = deltaPage(fsys, name, sums, req.Size, req.Offset)
+		}
+		if err != nil || resp.EOF {
+			delete(deltas, req.Delta)
+		}
+	case "clone":
+		var file File
+		file, err = fsClone(fsys, name, req.NewName, context.Background())
+		if err == nil {
+			resp.Name = filepath.Base(file.Name())
+			err = file.Close()
+		}
+	case "truncate":
+		var file File
+		file, err = fsOpenFile(fsys, name)
+		if err == nil {
+			err = file.Truncate(req.Offset)
+			file.Close()
+		}
+	case "copyrange":
+		err = copyRange(fsys, newName, name, req.From, req.Offset, req.Size)
+	default:
+		err = fmt.Errorf("unknown operation %q: %w", req.Op, errors.ErrUnsupported)
+	}
+	if err != nil {
+		return peerFail(resp, err)
+	}
+	return resp
+}
+
+// Заполнение ответа с ошибкой
+func peerFail(resp *peerResponse, err error) *peerResponse {
+	resp.Err = err.Error()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		resp.Code = peerErrNotExist
+	case errors.Is(err, fs.ErrExist):
+		resp.Code = peerErrExist
+	case errors.Is(err, fs.ErrInvalid):
+		resp.Code = peerErrInvalid
+	case errors.Is(err, errors.ErrUnsupported):
+		resp.Code = peerErrUnsupported
+	case errors.Is(err, fs.ErrPermission):
+		resp.Code = peerErrPermission
+	default:
+		resp.Code = peerErrOther
+	}
+	return resp
+}
+
+// Чтение блока файла
+func readBlock(fsys FS, name string, offset int64, size int) ([]byte, bool, error) {
+	if size <= 0 || size > peerBlockSize {
+		size = peerBlockSize
+	}
+	file, err := fsOpenAt(fsys, name, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	data := make([]byte, size)
+	n, err := io.ReadFull(file, data)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return data[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data[:n], false, nil
+}
+
+// Проверка размера блока сигнатуры из запроса
+func checkBlockSize(size int) error {
+	if size < deltaMinBlock || size > deltaMaxBlock {
+		return fmt.Errorf("block size %d: %w", size, fs.ErrInvalid)
+	}
+	return nil
+}
+
+// Максимальное количество незавершённых передач разницы одного клиента
+const maxPeerDeltas = 8
+
+// Получение сигнатуры для запроса части разницы. Сигнатура из первого
+// запроса передачи сохраняется, следующие запросы используют её.
+// При переполнении забываются самые старые передачи
+func deltaSums(deltas map[uint64][]BlockSum, req *peerRequest) ([]BlockSum, error) {
+	if req.Sums != nil {
+		for len(deltas) >= maxPeerDeltas {
+			first, oldest := true, uint64(0)
+			for id := range deltas {
+				if first || id < oldest {
+					first, oldest = false, id
+				}
+			}
+			delete(deltas, oldest)
+		}
+		deltas[req.Delta] = req.Sums
+		return req.Sums, nil
+	}
+	sums, ok := deltas[req.Delta]
+	if !ok {
+		return nil, fmt.Errorf("delta %d has no signature: %w", req.Delta, fs.ErrInvalid)
+	}
+	return sums, nil
+}
+
+// Признак заполненной части разницы
+var errDeltaPage = errors.New("delta page is full")
+
+// Вычисление части разницы файла с сигнатурой, начиная со смещения offset.
+// Часть ограничена по объёму новых данных и количеству операций
+func deltaPage(fsys FS, name string, sums []BlockSum, blockSize int, offset int64) ([]DeltaOp, bool, error) {
+	err := checkBlockSize(blockSize)
+	if err != nil {
+		return nil, false, err
+	}
+	file, err := fsOpenAt(fsys, name, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	var ops []DeltaOp
+	size := 0
+	err = scanDelta(file, sums, blockSize, offset, func(op DeltaOp) error {
+		ops = append(ops, op)
+		size += len(op.Data)
+		if size >= peerBlockSize || len(ops) >= peerBlockSize/64 {
+			return errDeltaPage
+		}
+		return nil
+	})
+	if errors.Is(err, errDeltaPage) {
+		return ops, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return ops, true, nil
+}
+
+// Копирование участка файла src в файл dst
+func copyRange(fsys FS, src, dst string, from, to int64, size int) error {
+	if size <= 0 || size > peerBlockSize {
+		return fmt.Errorf("range size %d: %w", size, fs.ErrInvalid)
+	}
+	file, err := fsOpenAt(fsys, src, from)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data := make([]byte, size)
+	n, err := io.ReadFull(file, data)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	return writeBlock(fsys, dst, to, data[:n])
+}
+
+// Запись блока файла
+func writeBlock(fsys FS, name string, offset int64, data []byte) error {
+	file, err := fsOpenFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, offset)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,347 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Действия над файлами в плане синхронизации
+const (
+	PlanCreate    = "create"
+	PlanOverwrite = "overwrite"
+	PlanDelete    = "delete"
+	PlanMeta      = "meta"
+	PlanMove      = "move"
+)
+
+// Действие, которое синхронизация выполнила бы с файлом директории.
+// Имена указываются относительно директории
+type PlanAction struct {
+	Op   string `json:"op"`
+	Name string `json:"name"`
+	To   string `json:"to,omitempty"`
+}
+
+// План синхронизации одной директории
+type RootPlan struct {
+	Path string `json:"path"`
+	// Причина, по которой синхронизация директории была бы приостановлена
+	Paused string `json:"paused,omitempty"`
+	// Продолжение синхронизации требует подтверждения
+	NeedConfirm bool         `json:"need_confirm,omitempty"`
+	Actions     []PlanAction `json:"actions"`
+}
+
+// Вычисление плана синхронизации директорий без изменения файлов.
+// Для каждой директории сначала в копию буфера собираются изменения
+// остальных директорий, затем записываются действия одного цикла
+// синхронизации самой директории. Буфер при этом не меняется
+func (buf *BufInfo) Plan(paths []string, ctx context.Context) ([]RootPlan, error) {
+	plans := make([]RootPlan, 0, len(paths))
+	for _, path := range paths {
+		pfs := NewPlanFS(buf.fsys())
+		pbuf := buf.planCopy(pfs)
+		for _, other := range paths {
+			if other == path {
+				continue
+			}
+			var tm time.Time
+			err := pbuf.SyncFiles(other, &tm, ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		pfs.reset()
+		var tm time.Time
+		err := pbuf.SyncFiles(path, &tm, ctx)
+		if err != nil {
+			return nil, err
+		}
+		plan := RootPlan{Path: path, Actions: pfs.actions(path)}
+		if state, ok := (*pbuf).roots[path]; ok {
+			plan.Paused = state.paused
+			plan.NeedConfirm = state.needConfirm
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// Копия буфера для вычисления плана, работающая с файловой системой fsys
+func (buf *BufInfo) planCopy(fsys FS) *BufInfo {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	pbuf := InitBufInfo()
+	(*pbuf).opts = (*buf).opts
+	(*pbuf).opts.FS = fsys
+	for name, fInfo := range (*buf).files {
+		(*pbuf).files[name] = fInfo.clone()
+	}
+	(*pbuf).tomb = maps.Clone((*buf).tomb)
+	(*pbuf).updTime = (*buf).updTime
+	(*pbuf).names = (*buf).names
+	for path, inodes := range (*buf).inodes {
+		(*pbuf).inodes[path] = maps.Clone(inodes)
+	}
+	for path, state := range (*buf).roots {
+		copied := *state
+		copied.touched = maps.Clone(state.touched)
+		(*pbuf).roots[path] = &copied
+	}
+	(*buf).hashMu.Lock()
+	(*pbuf).hashes = maps.Clone((*buf).hashes)
+	(*buf).hashMu.Unlock()
+	for _, failure := range buf.Failures() {
+		copied := failure
+		(*pbuf).failures[failureKey(failure.Path, failure.Name)] = &copied
+	}
+	return pbuf
+}
+
+// Файловая система для вычисления плана: чтение выполняется из
+// базовой файловой системы, а изменения только записываются в план
+type PlanFS struct {
+	base FS
+
+	mu    sync.Mutex
+	seq   int
+	temps map[string]struct{}
+	list  []PlanAction
+	index map[string]int
+}
+
+// Создание файловой системы для плана поверх base
+func NewPlanFS(base FS) *PlanFS {
+	pfs := &PlanFS{base: base}
+	pfs.reset()
+	return pfs
+}
+
+// Очистка записанных действий
+func (pfs *PlanFS) reset() {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	pfs.temps = make(map[string]struct{})
+	pfs.list = nil
+	pfs.index = make(map[string]int)
+}
+
+// Запись действия. Изменение метаданных не записывается для файла,
+// который уже создаётся или перезаписывается, и заменяется таким действием
+func (pfs *PlanFS) record(op, name, to string) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	if _, ok := pfs.temps[name]; ok {
+		return
+	}
+	if i, ok := pfs.index[name]; ok {
+		if op == PlanMeta {
+			return
+		}
+		if pfs.list[i].Op == PlanMeta {
+			pfs.list[i] = PlanAction{Op: op, Name: name, To: to}
+			return
+		}
+	}
+	pfs.index[name] = len(pfs.list)
+	pfs.list = append(pfs.list, PlanAction{Op: op, Name: name, To: to})
+}
+
+// Запись создания или перезаписи файла
+func (pfs *PlanFS) recordWrite(name string) {
+	if _, err := pfs.base.Lstat(name); err == nil {
+		pfs.record(PlanOverwrite, name, "")
+	} else {
+		pfs.record(PlanCreate, name, "")
+	}
+}
+
+// Проверка, что файл - временный файл плана
+func (pfs *PlanFS) isTemp(name string) bool {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	_, ok := pfs.temps[name]
+	return ok
+}
+
+// Проверка, что файл существует только в плане: это временный файл
+// или файл, который план создаёт или перезаписывает
+func (pfs *PlanFS) planned(name string) bool {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	if _, ok := pfs.temps[name]; ok {
+		return true
+	}
+	i, ok := pfs.index[name]
+	return ok && (pfs.list[i].Op == PlanCreate || pfs.list[i].Op == PlanOverwrite)
+}
+
+// Получение действий в директории path. Служебные файлы
+// синхронизации и версии файлов в план не входят
+func (pfs *PlanFS) actions(path string) []PlanAction {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	list := make([]PlanAction, 0, len(pfs.list))
+	for _, action := range pfs.list {
+		name, err := filepath.Rel(path, action.Name)
+		if err != nil || name == "." || strings.HasPrefix(name, "..") ||
+			name == ConfirmFile || name == RetryFile || name == LockFile ||
+			name == VersionsDir ||
+			strings.HasPrefix(name, VersionsDir+string(filepath.Separator)) {
+			continue
+		}
+		action.Name = name
+		if action.To != "" {
+			action.To, _ = filepath.Rel(path, action.To)
+		}
+		list = append(list, action)
+	}
+	return list
+}
+
+func (pfs *PlanFS) Stat(name string) (fs.FileInfo, error) {
+	return pfs.base.Stat(name)
+}
+
+func (pfs *PlanFS) Lstat(name string) (fs.FileInfo, error) {
+	return pfs.base.Lstat(name)
+}
+
+func (pfs *PlanFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return pfs.base.ReadDir(name)
+}
+
+func (pfs *PlanFS) Readlink(name string) (string, error) {
+	return pfs.base.Readlink(name)
+}
+
+// Данные файлов, которые существуют только в плане, никуда не записывались,
+// поэтому такие файлы читаются пустыми
+func (pfs *PlanFS) Open(name string) (io.ReadCloser, error) {
+	if pfs.planned(name) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return pfs.base.Open(name)
+}
+
+// Создание временного файла, данные которого никуда не записываются
+func (pfs *PlanFS) CreateTemp(dir, pattern string) (File, error) {
+	pfs.mu.Lock()
+	defer pfs.mu.Unlock()
+	pfs.seq++
+	name := filepath.Join(dir, strings.Replace(pattern, "*", "plan"+strconv.Itoa(pfs.seq), 1))
+	pfs.temps[name] = struct{}{}
+	return planFile{name: name}, nil
+}
+
+func (pfs *PlanFS) Clone(name, pattern string) (File, error) {
+	return pfs.CreateTemp(filepath.Dir(name), pattern)
+}
+
+// Сигнатура и разница для плана не вычисляются: файл, переданный
+// разницей, записывается в план переименованием временного файла
+func (pfs *PlanFS) Signature(name string, blockSize int) ([]BlockSum, error) {
+	return nil, nil
+}
+
+func (pfs *PlanFS) Delta(name string, sums []BlockSum, blockSize int, emit func(op DeltaOp) error) error {
+	return nil
+}
+
+func (pfs *PlanFS) Mkdir(name string, perm fs.FileMode) error {
+	pfs.record(PlanCreate, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) MkdirAll(name string, perm fs.FileMode) error {
+	if _, err := pfs.base.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		pfs.record(PlanCreate, name, "")
+	}
+	return nil
+}
+
+func (pfs *PlanFS) Symlink(target, name string) error {
+	pfs.recordWrite(name)
+	return nil
+}
+
+func (pfs *PlanFS) Remove(name string) error {
+	pfs.record(PlanDelete, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) RemoveAll(name string) error {
+	pfs.record(PlanDelete, name, "")
+	return nil
+}
+
+// Переименование временного файла означает запись целевого файла
+func (pfs *PlanFS) Rename(oldName, newName string) error {
+	if pfs.isTemp(oldName) {
+		pfs.recordWrite(newName)
+		return nil
+	}
+	pfs.record(PlanMove, oldName, newName)
+	return nil
+}
+
+func (pfs *PlanFS) Chmod(name string, mode fs.FileMode) error {
+	pfs.record(PlanMeta, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) Chtimes(name string, atime, mtime time.Time) error {
+	pfs.record(PlanMeta, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) Lchtimes(name string, mtime time.Time) error {
+	pfs.record(PlanMeta, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) Lchown(name string, uid, gid int) error {
+	pfs.record(PlanMeta, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) ReadXattrs(name string, keep func(string) bool) (map[string][]byte, error) {
+	if xfs, ok := pfs.base.(XattrFS); ok {
+		return xfs.ReadXattrs(name, keep)
+	}
+	return nil, nil
+}
+
+func (pfs *PlanFS) WriteXattrs(name string, attrs map[string][]byte, keep func(string) bool) error {
+	pfs.record(PlanMeta, name, "")
+	return nil
+}
+
+func (pfs *PlanFS) Link(oldName, newName string) error {
+	pfs.recordWrite(newName)
+	return nil
+}
+
+// Временный файл плана
+type planFile struct {
+	name string
+}
+
+func (file planFile) Write(data []byte) (int, error)                 { return len(data), nil }
+func (file planFile) WriteAt(data []byte, offset int64) (int, error) { return len(data), nil }
+func (file planFile) Close() error                                   { return nil }
+func (file planFile) Name() string                                   { return file.name }
+func (file planFile) Sync() error                                    { return nil }
+func (file planFile) Truncate(size int64) error                      { return nil }
@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Время, в течение которого размер и время изменения файла
+// не должны меняться, чтобы файл считался записанным
+const DefaultSettle = time.Second
+
+// Исходный файл изменился во время копирования
+var errSourceChanged = errors.New("source file is changed during copy")
+
+// Наблюдение за файлом, который ещё записывается
+type settleInfo struct {
+	path    string
+	name    string
+	size    int64
+	modTime time.Time
+	// Время, с которого размер и время изменения не меняются
+	since time.Time
+}
+
+// Проверка, что файл директории path уже записан: его размер и время
+// изменения не менялись в течение opts.Settle. Пока файл записывается,
+// он не попадает в буфер и не перезаписывается из буфера
+func (buf *BufInfo) settled(path, name string, info os.FileInfo) bool {
+	settle := (*buf).opts.Settle
+	if settle <= 0 || !info.Mode().IsRegular() {
+		return true
+	}
+	fullPath := filepath.Join(path, name)
+	now := time.Now()
+
+	(*buf).settleMu.Lock()
+	defer (*buf).settleMu.Unlock()
+	prev, ok := (*buf).settling[fullPath]
+	if now.Sub(info.ModTime()) >= settle {
+		delete((*buf).settling, fullPath)
+		return true
+	}
+	if ok && prev.size == info.Size() && prev.modTime.Equal(info.ModTime()) {
+		if now.Sub(prev.since) >= settle {
+			delete((*buf).settling, fullPath)
+			return true
+		}
+		return false
+	}
+	if !ok {
+		slog.Debug("File is being written, synchronisation is postponed",
+			"Path", path,
+			"File", name,
+			"Size", info.Size())
+	}
+	(*buf).settling[fullPath] = &settleInfo{
+		path:    path,
+		name:    name,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		since:   now,
+	}
+	return false
+}
+
+// Удаление наблюдений за файлами, которых больше нет в директории
+func (buf *BufInfo) dropSettling(path string, entries []pathEntry) {
+	(*buf).settleMu.Lock()
+	defer (*buf).settleMu.Unlock()
+	if len((*buf).settling) == 0 {
+		return
+	}
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		seen[entry.name] = struct{}{}
+	}
+	for key, info := range (*buf).settling {
+		if info.path != path {
+			continue
+		}
+		if _, ok := seen[info.name]; !ok {
+			delete((*buf).settling, key)
+		}
+	}
+}
+
+// Проверка, что в директории есть файлы, которые ещё записываются.
+// Возвращает задержку, после которой все они могут считаться записанными
+func (buf *BufInfo) settleWait(path string) (time.Duration, bool) {
+	settle := (*buf).opts.Settle
+	now := time.Now()
+	(*buf).settleMu.Lock()
+	defer (*buf).settleMu.Unlock()
+	var wait time.Duration
+	found := false
+	for _, info := range (*buf).settling {
+		if info.path != path {
+			continue
+		}
+		found = true
+		ready := info.since.Add(settle)
+		if tm := info.modTime.Add(settle); tm.Before(ready) {
+			ready = tm
+		}
+		wait = max(wait, ready.Sub(now))
+	}
+	return wait, found
+}
+
+// Задержка до момента, когда директорию нужно проверить снова без
+// событий об изменениях: файл может стать записанным или может
+// подойти время повторить операцию после ошибки. 0 - ждать нечего
+func (buf *BufInfo) pendingDelay(path string) time.Duration {
+	now := time.Now()
+	var next time.Time
+	later := func(tm time.Time) {
+		if tm.After(now) && (next.IsZero() || tm.Before(next)) {
+			next = tm
+		}
+	}
+
+	settle := (*buf).opts.Settle
+	(*buf).settleMu.Lock()
+	for _, info := range (*buf).settling {
+		if info.path == path {
+			later(info.modTime.Add(settle))
+			later(info.since.Add(settle))
+		}
+	}
+	(*buf).settleMu.Unlock()
+
+	(*buf).failMu.Lock()
+	for _, failure := range (*buf).failures {
+		if failure.Path == path && !failure.Quarantined {
+			later(failure.Next)
+		}
+	}
+	(*buf).failMu.Unlock()
+
+	if next.IsZero() {
+		return 0
+	}
+	return next.Sub(now)
+}
+
+// Проверка, что исходный файл не изменился с момента before,
+// в том числе во время чтения
+func (buf *BufInfo) checkSource(name string, before os.FileInfo) error {
+	after, err := buf.fsys().Stat(name)
+	if err != nil {
+		return err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return fmt.Errorf("%s: %w", name, errSourceChanged)
+	}
+	return nil
+}
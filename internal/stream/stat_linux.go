@@ -0,0 +1,34 @@
+package stream
+
+import (
+	"os"
+	"syscall"
+)
+
+// Идентификатор файла в файловой системе
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// Получение времени изменения inode файла в наносекундах
+func changeTime(info os.FileInfo) int64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return st.Ctim.Nano()
+}
+
+// Получение устройства и inode файла
+func fileKey(info os.FileInfo) (fileID, bool) {
+	// Удалённые файловые системы передают идентификатор файла сами
+	if id, ok := info.Sys().(fileID); ok {
+		return id, id != fileID{}
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}, true
+}
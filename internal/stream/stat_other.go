@@ -0,0 +1,26 @@
+//go:build !linux
+
+package stream
+
+import "os"
+
+// Идентификатор файла в файловой системе
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// Получение времени изменения inode файла в наносекундах.
+// На других системах не поддерживается
+func changeTime(info os.FileInfo) int64 {
+	return 0
+}
+
+// Получение устройства и inode файла. На других системах
+// поддерживается только для удалённых файловых систем
+func fileKey(info os.FileInfo) (fileID, bool) {
+	if id, ok := info.Sys().(fileID); ok {
+		return id, id != fileID{}
+	}
+	return fileID{}, false
+}
@@ -0,0 +1,193 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Сохранённое состояние относится к другому набору директорий
+var ErrStateDirs = errors.New("state is saved for other directories")
+
+// Состояние буфера, сохраняемое на диск между запусками
+type stateInfo struct {
+	// Упорядоченный список синхронизируемых директорий
+	Paths    []string             `json:"paths,omitempty"`
+	Files    map[string]*FileInfo `json:"files"`
+	Tomb     []string             `json:"tomb"`
+	UpdTime  time.Time            `json:"upd_time"`
+	Roots    map[string]fileID    `json:"roots,omitempty"`
+	Failures []Failure            `json:"failures,omitempty"`
+}
+
+// Сохранение состояния буфера в файл
+func (buf *BufInfo) SaveState(fileName string) error {
+	(*buf).mu.RLock()
+	state := stateInfo{
+		Paths:   sortedPaths((*buf).paths),
+		Files:   make(map[string]*FileInfo, len((*buf).files)),
+		Tomb:    make([]string, 0, len((*buf).tomb)),
+		UpdTime: (*buf).updTime,
+		Roots:   make(map[string]fileID, len((*buf).roots)),
+	}
+	for name, fInfo := range (*buf).files {
+		state.Files[name] = fInfo.clone()
+	}
+	for name := range (*buf).tomb {
+		state.Tomb = append(state.Tomb, name)
+	}
+	for path, root := range (*buf).roots {
+		state.Roots[path] = root.ID
+	}
+	(*buf).mu.RUnlock()
+	state.Failures = buf.Failures()
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	// Запись через временный файл, чтобы не оставить повреждённое состояние
+	tmpName := fileName + ".tmp"
+	err = os.WriteFile(tmpName, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// Загрузка состояния буфера из файла. Состояние, сохранённое для другого
+// набора директорий, не загружается, чтобы не потерять удалённые файлы.
+// Из состояния без списка директорий удаляются директории, которых нет среди paths
+func LoadState(fileName string, paths []string, opts Options) (*BufInfo, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var state stateInfo
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Paths != nil && !slices.Equal(state.Paths, sortedPaths(paths)) {
+		return nil, fmt.Errorf("%s: %w: %s", fileName, ErrStateDirs,
+			strings.Join(state.Paths, ", "))
+	}
+
+	buf := InitBufInfo()
+	(*buf).opts = opts
+	(*buf).paths = slices.Clone(paths)
+	for name, fInfo := range state.Files {
+		if fInfo == nil {
+			continue
+		}
+		(*buf).files[name] = fInfo
+	}
+	for _, name := range state.Tomb {
+		(*buf).tomb[name] = struct{}{}
+	}
+	(*buf).updTime = state.UpdTime
+	for path, id := range state.Roots {
+		if slices.Contains(paths, path) {
+			(*buf).roots[path] = &rootState{ID: id}
+		}
+	}
+	for _, failure := range state.Failures {
+		if slices.Contains(paths, failure.Path) {
+			copied := failure
+			(*buf).failures[failureKey(failure.Path, failure.Name)] = &copied
+		}
+	}
+
+	buf.keepPaths(paths)
+	slog.Info("State is loaded.", "File", fileName,
+		"Files", len((*buf).files), "Tomb", len((*buf).tomb))
+
+	return buf, nil
+}
+
+// Упорядоченная копия списка директорий
+func sortedPaths(paths []string) []string {
+	sorted := slices.Clone(paths)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// Удаление из буфера директорий, которые больше не синхронизируются
+func (buf *BufInfo) keepPaths(paths []string) {
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	for name, fInfo := range (*buf).files {
+		where := fInfo.Where[:0]
+		for _, path := range fInfo.Where {
+			if slices.Contains(paths, path) {
+				where = append(where, path)
+			}
+		}
+		fInfo.Where = where
+		for seenPath := range fInfo.Seen {
+			if !slices.Contains(paths, seenPath) {
+				delete(fInfo.Seen, seenPath)
+			}
+		}
+
+		if len(fInfo.Where) == 0 {
+			delete((*buf).files, name)
+			delete((*buf).tomb, name)
+			continue
+		}
+
+		// Источник файла должен находиться в одной из директорий
+		if !fromPaths(fInfo.From, paths) {
+			fInfo.From = filepath.Join(fInfo.Where[0], name)
+		}
+	}
+	for name := range (*buf).tomb {
+		if _, ok := (*buf).files[name]; !ok {
+			delete((*buf).tomb, name)
+		}
+	}
+}
+
+// Проверка, что путь находится внутри одной из директорий
+func fromPaths(from string, paths []string) bool {
+	for _, path := range paths {
+		rel, err := filepath.Rel(path, from)
+		if err != nil {
+			continue
+		}
+		if rel != "." && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Периодическое сохранение состояния буфера до завершения контекста
+func (buf *BufInfo) RunSaveState(fileName string, period time.Duration, ctx context.Context) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := buf.SaveState(fileName)
+			if err != nil {
+				slog.Error("Save state error",
+					"File", fileName,
+					"Error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package stream
+
+// Результаты синхронизации с момента создания буфера
+type Stats struct {
+	// Созданные и перезаписанные файлы и ссылки
+	Copied int64
+	// Размер скопированных файлов в байтах
+	Bytes     int64
+	Deleted   int64
+	Moved     int64
+	Meta      int64
+	Conflicts int64
+	// Ошибки с отдельными файлами и при чтении директорий
+	Errors int64
+}
+
+// Добавление результатов к счётчикам буфера
+func (buf *BufInfo) addStats(stats Stats) {
+	(*buf).statsMu.Lock()
+	defer (*buf).statsMu.Unlock()
+	(*buf).stats.Copied += stats.Copied
+	(*buf).stats.Bytes += stats.Bytes
+	(*buf).stats.Deleted += stats.Deleted
+	(*buf).stats.Moved += stats.Moved
+	(*buf).stats.Meta += stats.Meta
+	(*buf).stats.Conflicts += stats.Conflicts
+	(*buf).stats.Errors += stats.Errors
+}
+
+// Получение результатов синхронизации
+func (buf *BufInfo) Stats() Stats {
+	(*buf).statsMu.Lock()
+	defer (*buf).statsMu.Unlock()
+	return (*buf).stats
+}
+
+// Учёт скопированного файла. Директории не учитываются
+func (buf *BufInfo) countCopy(fInfo *FileInfo) {
+	if (*fInfo).IsDir {
+		return
+	}
+	stats := Stats{Copied: 1}
+	if !(*fInfo).IsLink {
+		stats.Bytes = (*fInfo).Size
+	}
+	buf.addStats(stats)
+}
+
+// Учёт ошибки с файлом
+func (buf *BufInfo) countError() {
+	buf.addStats(Stats{Errors: 1})
+}
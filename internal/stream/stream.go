@@ -1,10 +1,13 @@
 package stream
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
@@ -18,85 +21,402 @@ type FileInfo struct {
 	Mode    fs.FileMode
 	Size    int64
 	IsDir   bool
+	IsLink  bool
+	Link    string
 	ModTime time.Time
+	Hash    string
+	Seen    map[string]Version
+	MovedTo string
+	Uid     int
+	Gid     int
+	Xattrs  map[string][]byte
 }
 
 type BufInfo struct {
+	// Синхронизируемые директории
+	paths   []string
 	files   map[string]*FileInfo
 	tomb    map[string]struct{}
 	updTime time.Time
 	mu      sync.RWMutex
+	opts    Options
+	hashes  map[string]hashInfo
+	hashMu  sync.Mutex
+	updated chan struct{}
+	inodes  map[string]map[fileID]string
+	roots   map[string]*rootState
+	stats   Stats
+	statsMu sync.Mutex
+	// Счётчик добавлений и удалений имён файлов в буфере
+	names uint64
+	// Имена файлов, изменённых в буфере, по порядку изменений,
+	// и номер первого из них с момента запуска
+	journal      []string
+	journalStart uint64
+	// Расширенные атрибуты файлов по полному пути
+	metas  map[string]metaInfo
+	metaMu sync.Mutex
+	// Ошибки операций с файлами по полному пути
+	failures map[string]*Failure
+	failMu   sync.Mutex
+	// Файлы, которые ещё записываются, по полному пути
+	settling map[string]*settleInfo
+	settleMu sync.Mutex
 }
 
-// Запуск синхронизации заданой директории с буфером
+// Максимальная задержка перед повторной синхронизацией недоступной директории
+const maxRetryDelay = time.Minute
+
+// Запуск синхронизации заданой директории с буфером.
+// Изменения в директории отслеживаются через inotify, и синхронизируются
+// только изменённые поддеревья и изменённые в буфере файлы. Если отслеживание
+// невозможно, директория целиком проверяется с заданным интервалом.
+// Если директория недоступна, синхронизация повторяется с растущей
+// задержкой, а остальные директории продолжают синхронизироваться
 func (buf *BufInfo) RunSync(path string, tmMult int, ctx context.Context) {
 	var tm time.Time
+	interval := time.Millisecond * time.Duration(tmMult)
+
+	// inotify работает только с локальным диском
+	wantWatch := buf.isLocal(path) && !(*buf).opts.Poll
+	useWatch := wantWatch
+	var watch *Watcher
+	defer func() {
+		if watch != nil {
+			watch.Close()
+		}
+	}()
 
+	if (*buf).opts.Versions {
+		err := PruneVersions(buf.fsys(), path, (*buf).opts.KeepVersions, (*buf).opts.KeepDays)
+		if err != nil {
+			slog.Warn("Can't prune versions",
+				"Path", path,
+				"Error", err)
+		}
+	}
+
+	failures := 0
+	// Полный обход нужен в первом цикле, без отслеживания изменений
+	// и после потери событий
+	full := true
+	var changed []string
+	var pos uint64
 	for {
-		select {
-		case <-ctx.Done():
+		updated := buf.updatedChan()
+		names, next, ok := buf.journalSince(pos)
+		pos = next
+		var err error
+		if full || !ok {
+			err = buf.SyncFiles(path, &tm, ctx)
+		} else {
+			err = buf.SyncNames(path, changed, names, &tm, ctx)
+		}
+		// После приостановки, например до подтверждения массового
+		// удаления, директория обходится целиком
+		full, changed = buf.Paused(path) != "", nil
+		if ctx.Err() != nil {
 			return
-		default:
-			time.Sleep(time.Millisecond *
-				time.Duration(tmMult))
-			err := buf.SyncFiles(path, &tm)
+		}
+		if err == nil {
+			err = buf.rootError(path)
+		}
+
+		if err != nil {
+			failures++
+			delay := retryDelay(interval, failures)
+			if failures == 1 {
+				slog.Warn("Directory is degraded, synchronisation is retried",
+					"Path", path,
+					"Error", err,
+					"Retry", delay)
+			} else {
+				slog.Debug("Directory is still degraded",
+					"Path", path,
+					"Error", err,
+					"Attempt", failures,
+					"Retry", delay)
+			}
+			// Отслеживание пропавшей директории устанавливается заново после восстановления
+			if watch != nil {
+				watch.Close()
+				watch = nil
+			}
+			full = true
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		if failures > 0 {
+			slog.Info("Directory is recovered",
+				"Path", path,
+				"Attempts", failures)
+			failures = 0
+			useWatch = wantWatch
+		}
+		if useWatch && watch == nil {
+			var ig *Ignore
+			ig, err = LoadIgnore(buf.fsys(), path, (*buf).opts.Ignore)
+			if err == nil {
+				watch, err = NewWatcher(path, ig)
+			}
 			if err != nil {
-				fmt.Println(err)
+				slog.Warn("Can't watch directory, polling is used",
+					"Path", path,
+					"Error", err)
+				watch = nil
+				useWatch = false
+			} else {
+				// Изменения до начала отслеживания находятся ещё одним полным обходом
+				full = true
+				continue
+			}
+		}
+
+		if watch == nil {
+			full = true
+			select {
+			case <-ctx.Done():
 				return
+			case <-time.After(interval):
 			}
+			continue
+		}
+
+		changed, full, err = waitEvents(watch, updated, interval, buf.pendingDelay(path), ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("Watch error, polling is used",
+				"Path", path,
+				"Error", err)
+			watch.Close()
+			watch = nil
+			useWatch = false
+			full = true
+		} else if slices.Contains(changed, IgnoreFile) {
+			// Отслеживание устанавливается заново с новыми шаблонами исключений,
+			// так как директории, которые больше не исключены, не отслеживаются
+			watch.Close()
+			watch = nil
+			full = true
+		}
+	}
+}
+
+// Задержка перед повторной синхронизацией после failures неудачных
+// циклов подряд: интервал удваивается после каждой неудачи
+func retryDelay(interval time.Duration, failures int) time.Duration {
+	delay := max(interval, time.Millisecond)
+	for i := 0; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// Ошибка однократной синхронизации, после которой директории
+// всё ещё не совпадают, потому что файлы продолжают меняться
+var ErrNotSettled = errors.New("directories are still changing")
+
+// Однократная синхронизация директорий: циклы синхронизации всех директорий
+// повторяются, пока очередной проход не перестанет менять файлы.
+// Перед проходом ожидается, пока файлы, которые ещё записываются,
+// не будут считаться записанными.
+// Если файлы меняются и после последнего прохода, возвращается ErrNotSettled
+func (buf *BufInfo) SyncOnce(paths []string, ctx context.Context) error {
+	if (*buf).opts.Versions {
+		for _, path := range paths {
+			err := PruneVersions(buf.fsys(), path, (*buf).opts.KeepVersions, (*buf).opts.KeepDays)
+			if err != nil {
+				slog.Warn("Can't prune versions",
+					"Path", path,
+					"Error", err)
+			}
+		}
+	}
+
+	// Синхронизация закончена, когда каждая доступная директория
+	// синхронизирована с последним состоянием буфера и в ней
+	// нет файлов, которые ещё записываются
+	times := make([]time.Time, len(paths))
+	var wait time.Duration
+	for pass := 0; pass <= len(paths); pass++ {
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		for i, path := range paths {
+			err := buf.SyncFiles(path, &times[i], ctx)
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		done := true
+		wait = 0
+		for i, path := range paths {
+			if buf.Paused(path) != "" {
+				continue
+			}
+			if !buf.compareTime(&times[i]) {
+				done = false
+			}
+			if delay, ok := buf.settleWait(path); ok {
+				done = false
+				wait = max(wait, delay)
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+	return fmt.Errorf("after %d passes: %w", len(paths)+1, ErrNotSettled)
+}
+
+// Ожидание изменений в директории или в буфере. После первого события
+// остальные события собираются в течение интервала, чтобы
+// не запускать синхронизацию на каждое из них. Если wake больше 0,
+// ожидание заканчивается не позже чем через wake.
+// Возвращает имена изменённых файлов директории. true - события
+// потеряны или их слишком много, и директорию нужно обойти целиком
+func waitEvents(watch *Watcher, updated <-chan struct{}, interval, wake time.Duration, ctx context.Context) ([]string, bool, error) {
+	var names []string
+	seen := make(map[string]struct{})
+	full := false
+	collect := func(name string) {
+		// Пустое имя означает переполнение очереди событий
+		if name == "" || len(seen) >= maxEventNames {
+			full = true
+			return
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	var wakeC <-chan time.Time
+	if wake > 0 {
+		wakeTimer := time.NewTimer(wake)
+		defer wakeTimer.Stop()
+		wakeC = wakeTimer.C
+	}
+	select {
+	case <-ctx.Done():
+		return nil, false, nil
+	case <-wakeC:
+		return nil, false, nil
+	case <-updated:
+	case err := <-watch.Errors:
+		return nil, true, err
+	case name, ok := <-watch.Events:
+		if !ok {
+			return nil, true, fmt.Errorf("watcher is closed")
+		}
+		collect(name)
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, nil
+		case err := <-watch.Errors:
+			return nil, true, err
+		case name, ok := <-watch.Events:
+			if !ok {
+				return nil, true, fmt.Errorf("watcher is closed")
+			}
+			collect(name)
+		case <-timer.C:
+			return names, full, nil
 		}
 	}
 }
 
 // Основная функция синхронизации директории и буфера
-func (buf *BufInfo) SyncFiles(path string, modTime *time.Time) error {
-	_, err := os.Stat(path)
-	if err != nil {
-		return err
+func (buf *BufInfo) SyncFiles(path string, modTime *time.Time, ctx context.Context) error {
+	if !buf.checkRoot(path) {
+		return nil
 	}
 
-	check, _ := buf.comparePathInfo(path)
+	ig, err := LoadIgnore(buf.fsys(), path, (*buf).opts.Ignore)
 	if err != nil {
-		slog.Warn("Can't get file names",
+		slog.Warn("Can't load ignore patterns",
 			"From path", path,
 			"Error", err)
+		buf.countError()
+		buf.setRootError(path, err)
 		return nil
 	}
 
-	if !check && buf.compareTime(modTime) {
-		return nil
-	}
-
-	arr, err := MakePathArr(path)
+	// Директория обходится один раз за цикл, дальше используется
+	// полученная при обходе информация о файлах
+	entries, err := buf.scanPath(path, ig)
 	if err != nil {
 		slog.Warn("Can't get file names",
 			"From path", path,
 			"Error", err)
+		buf.countError()
+		buf.setRootError(path, err)
+		return nil
+	}
+	buf.setRootError(path, nil)
+	buf.consumeRetry(path)
+	buf.dropSettling(path, entries)
+
+	// Без изменений цикл выполняется только для повтора операций с файлами
+	check := buf.comparePathInfo(path, entries, ig)
+	if !check && buf.compareTime(modTime) && !buf.retryDue(path) {
 		return nil
 	}
 
-	buf.updateFromPath(path, arr)
+	inodes := make(map[fileID]string)
+	added := buf.updateFromPath(path, entries, ig, inodes, ctx)
+
+	bArr := buf.missingNames(path, entries, ig)
+	if !buf.allowDeletes(path, bArr, ig, inodes) {
+		return nil
+	}
 
-	bArr := buf.getAllNames()
-	bArr = buf.FindDifer(arr, bArr)
+	removed := buf.updateFromBuf(path, bArr, ig, ctx)
+	buf.dropStaleFailures(path)
 
-	slices.Sort(*bArr)
-	buf.updateFromBuf(path, bArr)
+	buf.detectMoves(path, added, removed, inodes, false)
+	buf.syncDirTimes(path)
 
 	buf.updateTime(modTime)
 
 	return nil
 }
 
-// Синхронизация файлов из буфера и проверяемой директории
-func (buf *BufInfo) updateFromBuf(path string, arr *[]string) {
-	for _, name := range *arr {
+// Синхронизация файлов из буфера и проверяемой директории.
+// Исключённые в директории файлы не копируются и не удаляются.
+// Возвращает имена файлов, удалённых из директории
+func (buf *BufInfo) updateFromBuf(path string, arr []string, ig *Ignore, ctx context.Context) []string {
+	var removed []string
+	for _, name := range arr {
 
 		fInf := buf.TakeFileInfo(name)
 		if fInf == nil {
 			continue
 		}
 
+		if ig.Match(name, (*fInf).IsDir) {
+			continue
+		}
+
 		if buf.inTomb(name) {
 			if fInf.emptyInfo(path) {
 				buf.delFromBuf(name)
@@ -104,18 +424,43 @@ func (buf *BufInfo) updateFromBuf(path string, arr *[]string) {
 			continue
 		}
 
+		// Файл есть в директории, но не попал в обход: он появился
+		// при переименовании в этом цикле или это пропускаемая ссылка
+		if _, err := buf.fsys().Lstat(filepath.Join(path, name)); err == nil {
+			continue
+		}
+
 		if fInf.findWhere(path) {
 			buf.eraseWherePath(path, name)
 			buf.addInTomb(name)
+			if !(*fInf).IsDir && !(*fInf).IsLink {
+				removed = append(removed, name)
+			}
 			slog.Info("Delete file from bufer",
 				"From path", path,
 				"File", name)
 		} else {
-			err := buf.BuildFile(path, name, fInf)
+			if !buf.canRetry(path, name) {
+				continue
+			}
+			err := buf.BuildFile(path, name, fInf, ctx)
+			if errors.Is(err, errSourceChanged) {
+				slog.Info("Source is changed during copy, file is copied later",
+					"Path", path,
+					"File", name)
+				continue
+			}
 			if err != nil {
+				slog.Error("Build error",
+					"Path", path,
+					"File", name,
+					"Error", err)
+				buf.fileFailed(path, name, "build", err)
 				continue
 			}
 			buf.addWherePath(path, name)
+			buf.countCopy(fInf)
+			buf.fileDone(path, name)
 			slog.Info("Add file in dir",
 				"To path", path,
 				"File", name,
@@ -123,29 +468,39 @@ func (buf *BufInfo) updateFromBuf(path string, arr *[]string) {
 		}
 
 	}
-	return
+	return removed
 }
 
-// Синхронизация файлов из проверяемой директории и буфера
-func (buf *BufInfo) updateFromPath(path string, arr *[]string) {
-	for _, name := range *arr {
+// Синхронизация файлов из проверяемой директории и буфера.
+// Используется информация о файлах, полученная при обходе директории.
+// В inodes записываются идентификаторы файлов директории.
+// Возвращает имена файлов, добавленных в буфер из директории
+func (buf *BufInfo) updateFromPath(path string, entries []pathEntry, ig *Ignore,
+	inodes map[fileID]string, ctx context.Context) []string {
+	var added, dirs []string
+	for _, entry := range entries {
+		name, info := entry.name, entry.info
 		fullPath := filepath.Join(path, name)
 
-		info, err := os.Stat(fullPath)
-		if err != nil {
-			if buf.findInfo(name) {
-				buf.eraseWherePath(path, name)
-				buf.addInTomb(name)
-				slog.Info("Delete file from bufer",
-					"From path", path,
-					"File", name)
+		if info.Mode().IsRegular() {
+			if key, ok := fileKey(info); ok {
+				inodes[key] = name
 			}
-			continue
 		}
 
 		fInf := buf.TakeFileInfo(name)
+
+		// Файл, который ещё записывается, синхронизируется после окончания записи
+		changed := fInf == nil || !fInf.IsDir && buf.fileChanged(name, fullPath, info, fInf)
+		if changed && !buf.settled(path, name, info) {
+			continue
+		}
+
 		if fInf == nil {
 			buf.buildInfo(name, path, &info)
+			if info.Mode().IsRegular() {
+				added = append(added, name)
+			}
 			slog.Info("Add in bufer",
 				"From", path,
 				"File", name,
@@ -153,7 +508,7 @@ func (buf *BufInfo) updateFromPath(path string, arr *[]string) {
 			continue
 		}
 
-		if !fInf.IsDir && !fInf.compareInfo(&info) {
+		if changed {
 			if buf.inTomb(name) {
 				buf.delFromTomb(name)
 			}
@@ -163,24 +518,89 @@ func (buf *BufInfo) updateFromPath(path string, arr *[]string) {
 					"From", path,
 					"File", name,
 					"Size", (*fInf).Size)
+			} else if buf.sameContent(name, fullPath, info, fInf) {
+				// Запись в директорию после ошибки откладывается
+				if !buf.canRetry(path, name) {
+					continue
+				}
+				err := buf.applyMeta(fullPath, fInf)
+				if err != nil {
+					slog.Error("Metadata error",
+						"Path", path,
+						"File", name,
+						"Error", err)
+					buf.fileFailed(path, name, "meta", err)
+					continue
+				}
+				buf.addWherePath(path, name)
+				buf.addStats(Stats{Meta: 1})
+				buf.fileDone(path, name)
+				slog.Info("Update file metadata",
+					"Path", path,
+					"File", name)
+				continue
 			} else {
-				err := os.RemoveAll(fullPath)
+				conflict := buf.changedSinceSync(path, fullPath, info, fInf)
+				// Запись в директорию после ошибки откладывается, но файл
+				// из директории, победивший в конфликте, попадает в буфер
+				if !buf.canRetry(path, name) && !(conflict && buf.localWins(path, name, info, fInf)) {
+					continue
+				}
+				if conflict {
+					local, err := buf.resolveConflict(path, name, info, fInf)
+					if err != nil {
+						slog.Error("Conflict error",
+							"Path", path,
+							"File", name,
+							"Error", err)
+						buf.fileFailed(path, name, "conflict", err)
+						continue
+					}
+					if local {
+						buf.buildInfo(name, path, &info)
+						continue
+					}
+				}
+				// Файл заменяется атомарно, удалять нужно только директорию
+				if info.IsDir() {
+					err := buf.removeFile(path, name)
+					if err != nil {
+						slog.Error("Remove error",
+							"Path", path,
+							"File", name,
+							"Error", err)
+						buf.fileFailed(path, name, "remove", err)
+						continue
+					}
+				}
+				err := buf.keepVersion(path, name, info, ctx)
 				if err != nil {
-					slog.Error("Remove error",
+					slog.Error("Version error",
 						"Path", path,
 						"File", name,
 						"Error", err)
+					buf.fileFailed(path, name, "version", err)
+					continue
+				}
+				buf.dropHash(fullPath)
+				err = buf.BuildFile(path, name, fInf, ctx)
+				if errors.Is(err, errSourceChanged) {
+					slog.Info("Source is changed during copy, file is copied later",
+						"Path", path,
+						"File", name)
 					continue
 				}
-				err = buf.BuildFile(path, name, fInf)
 				if err != nil {
 					slog.Error("Build error",
 						"Path", path,
 						"File", name,
 						"Error", err)
+					buf.fileFailed(path, name, "build", err)
 					continue
 				}
 				buf.addWherePath(path, name)
+				buf.countCopy(fInf)
+				buf.fileDone(path, name)
 				slog.Info("Rebuild file",
 					"Path", path,
 					"File", name,
@@ -189,19 +609,39 @@ func (buf *BufInfo) updateFromPath(path string, arr *[]string) {
 			}
 		}
 
+		if (*fInf).IsDir && info.IsDir() && !buf.inTomb(name) {
+			buf.updateDir(path, name, info, fInf)
+		}
+
 		if buf.inTomb(name) {
+			if !buf.canRetry(path, name) {
+				continue
+			}
+			if (*fInf).MovedTo != "" &&
+				buf.moveFile(path, name, info, fInf, ig, ctx) {
+				continue
+			}
 			buf.eraseWherePath(path, name)
 			if fInf.emptyInfo(path) {
 				buf.delFromBuf(name)
 			}
-			err := os.RemoveAll(fullPath)
+			// Директории удаляются после обхода, чтобы вложенные
+			// файлы успели переименоваться
+			if info.IsDir() {
+				dirs = append(dirs, name)
+				continue
+			}
+			err := buf.removeFile(path, name)
 			if err != nil {
 				slog.Error("Remove error",
 					"Path", path,
 					"File", name,
 					"Error", err)
+				buf.fileFailed(path, name, "remove", err)
 				continue
 			}
+			buf.addStats(Stats{Deleted: 1})
+			buf.fileDone(path, name)
 			slog.Info("File deleted",
 				"From path", path,
 				"File", name)
@@ -213,24 +653,68 @@ func (buf *BufInfo) updateFromPath(path string, arr *[]string) {
 		}
 
 	}
-	return
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := buf.removeFile(path, dirs[i])
+		if err != nil {
+			slog.Error("Remove error",
+				"Path", path,
+				"File", dirs[i],
+				"Error", err)
+			buf.fileFailed(path, dirs[i], "remove", err)
+			continue
+		}
+		buf.addStats(Stats{Deleted: 1})
+		buf.fileDone(path, dirs[i])
+		slog.Info("File deleted",
+			"From path", path,
+			"File", dirs[i])
+	}
+	return added
 }
 
-// Получение всех имён файлов из буфера
-func (buf *BufInfo) getAllNames() *[]string {
+// Получение отсортированных имён файлов буфера, которых нет среди файлов
+// директории. Исключённые в директории файлы не возвращаются. Если файлов
+// буфера столько же, сколько найдено в директории, буфер не перебирается
+func (buf *BufInfo) missingNames(path string, entries []pathEntry, ig *Ignore) []string {
+	total := buf.countNames(path, ig)
+
 	(*buf).mu.RLock()
 	defer (*buf).mu.RUnlock()
-	var tmp = &[]string{}
-	for name, _ := range (*buf).files {
-		*tmp = append(*tmp, name)
+	present := 0
+	for _, entry := range entries {
+		if _, ok := (*buf).files[entry.name]; ok {
+			present++
+		}
+	}
+	if present == total {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		seen[entry.name] = struct{}{}
+	}
+	var names []string
+	for name, fInfo := range (*buf).files {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		if !ig.Match(name, (*fInfo).IsDir) {
+			names = append(names, name)
+		}
 	}
-	return tmp
+	slices.Sort(names)
+	return names
 }
 
 // Удаление информации из буфера
 func (buf *BufInfo) delFromBuf(name string) {
 	(*buf).mu.Lock()
 	defer (*buf).mu.Unlock()
+	if _, ok := (*buf).files[name]; ok {
+		(*buf).names++
+	}
 	delete((*buf).files, name)
 	delete((*buf).tomb, name)
 }
@@ -247,7 +731,7 @@ func (buf *BufInfo) addInTomb(name string) {
 	(*buf).mu.Lock()
 	defer (*buf).mu.Unlock()
 	(*buf).tomb[name] = struct{}{}
-	buf.setTime()
+	buf.setTime(name)
 }
 
 // Проверка наличия имени файла в списке на удаление и его наличие в буфере
@@ -293,6 +777,7 @@ func (buf *BufInfo) eraseWherePath(path, name string) {
 			break
 		}
 	}
+	delete((*buf).files[name].Seen, path)
 }
 
 // Добавляет в буфера имя директории, в которую записанн файл
@@ -302,60 +787,105 @@ func (buf *BufInfo) addWherePath(path, name string) {
 	if _, ok := (*buf).files[name]; !ok {
 		return
 	}
-	(*buf).files[name].Where = append((*buf).files[name].Where, path)
-}
-
-// Поиск файлов в буфере, которых нет в проверяемой директории
-func (buf *BufInfo) FindDifer(arr, bufArr *[]string) *[]string {
-	var tmp = &[]string{}
-	for _, nameBuf := range *bufArr {
-		check := true
-		for _, nameArr := range *arr {
-			if nameBuf == nameArr {
-				check = false
-				break
-			}
-		}
-		if check {
-			*tmp = append(*tmp, nameBuf)
-		}
+	fInfo := (*buf).files[name]
+	(*fInfo).Where = append((*fInfo).Where, path)
+	if (*fInfo).Seen == nil {
+		(*fInfo).Seen = make(map[string]Version)
 	}
-	return tmp
+	(*fInfo).Seen[path] = fInfo.version()
 }
 
-// Создание файла или директории по образу из буфера
-func (buf *BufInfo) BuildFile(path, name string, fInfo *FileInfo) error {
+// Создание файла или директории по образу из буфера.
+// Копирование прерывается при отмене контекста
+func (buf *BufInfo) BuildFile(path, name string, fInfo *FileInfo, ctx context.Context) error {
+	// Копирование может быть долгим, поэтому блокировка буфера
+	// держится только на время снимка информации о файле
 	(*buf).mu.RLock()
-	defer (*buf).mu.RUnlock()
+	fInfo = fInfo.clone()
+	(*buf).mu.RUnlock()
+	buf.touchDir(path, name)
 	fullPath := filepath.Join(path, name)
-	if (*fInfo).IsDir {
-		err := os.MkdirAll(fullPath, (*fInfo).Mode)
+	if (*fInfo).IsLink {
+		err := buildLink(buf.fsys(), fullPath, (*fInfo).Link, (*fInfo).ModTime)
 		if err != nil {
 			return err
 		}
+		return buf.applyOwner(fullPath, fInfo)
+	} else if (*fInfo).IsDir {
+		err := buf.fsys().MkdirAll(fullPath, (*fInfo).Mode)
+		if err != nil {
+			return err
+		}
+		return buf.applyMeta(fullPath, fInfo)
 	} else {
-		fromPath := (*fInfo).From
-		data, err := os.ReadFile(fromPath)
+		// Исходный файл мог измениться после обхода директории
+		before, err := buf.fsys().Stat((*fInfo).From)
 		if err != nil {
 			return err
 		}
+		if before.Size() != (*fInfo).Size || !before.ModTime().Equal((*fInfo).ModTime) {
+			return fmt.Errorf("%s: %w", (*fInfo).From, errSourceChanged)
+		}
+
+		// Если в директории уже есть копия файла, передаются только изменения
+		done, err := buf.buildDelta(fullPath, fInfo, before, ctx)
+		if done {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, errSourceChanged) {
+				return err
+			}
+			slog.Warn("Delta transfer failed, file is copied",
+				"File", fullPath,
+				"Error", err)
+		}
 
-		err = os.WriteFile(fullPath, data, (*fInfo).Mode)
+		src, err := buf.fsys().Open((*fInfo).From)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		err = writeAtomic(buf.fsys(), fullPath, (*fInfo).Mode, (*fInfo).ModTime,
+			func(file File) error {
+				err := copyData(file, src, ctx)
+				if err != nil {
+					return err
+				}
+				err = buf.checkSource((*fInfo).From, before)
+				if err != nil {
+					return err
+				}
+				return buf.applyOwner(file.Name(), fInfo)
+			})
 		if err != nil {
 			return err
 		}
-		err = os.Chtimes(fullPath, (*fInfo).ModTime,
-			(*fInfo).ModTime)
 	}
 	return nil
 }
 
 // Создание буфера с информацией о всех файлах в заданых директориях
-func SyncInfo(paths []string) (*BufInfo, error) {
+func SyncInfo(paths []string, opts Options) (*BufInfo, error) {
 	buf := InitBufInfo()
+	(*buf).opts = opts
+	(*buf).paths = slices.Clone(paths)
 	for _, path := range paths {
+		// Недоступная директория приостанавливается при первой синхронизации
+		if _, err := buf.fsys().Stat(path); err != nil {
+			slog.Warn("Directory is unavailable",
+				"Path", path,
+				"Error", err)
+			continue
+		}
+
+		ig, err := LoadIgnore(buf.fsys(), path, opts.Ignore)
+		if err != nil {
+			return buf, err
+		}
 
-		arr, err := MakePathArr(path)
+		arr, err := MakePathArr(buf.fsys(), path, ig, opts.Links)
 		if err != nil {
 			return buf, err
 		}
@@ -375,7 +905,10 @@ func SyncInfo(paths []string) (*BufInfo, error) {
 func (buf *BufInfo) AddAllInfo(path string, names []string) {
 	for _, name := range names {
 		fullPath := filepath.Join(path, name)
-		info, _ := os.Stat(fullPath)
+		info, err := buf.stat(fullPath)
+		if err != nil {
+			continue
+		}
 		if !buf.findInfo(name) {
 			buf.buildInfo(name, path, &info)
 			continue
@@ -409,7 +942,7 @@ func (buf *BufInfo) compareInfo(name string, info *os.FileInfo) bool {
 	if (*buf).files[name].Size != (*info).Size() {
 		return false
 	}
-	if (*buf).files[name].Mode.Perm() != (*info).Mode().Perm() {
+	if (*buf).files[name].Mode&modeBits != (*info).Mode()&modeBits {
 		return false
 	}
 	return true
@@ -423,7 +956,7 @@ func (fInfo *FileInfo) compareInfo(info *os.FileInfo) bool {
 	if (*fInfo).Size != (*info).Size() {
 		return false
 	}
-	if (*fInfo).Mode.Perm() != (*info).Mode().Perm() {
+	if (*fInfo).Mode&modeBits != (*info).Mode()&modeBits {
 		return false
 	}
 	return true
@@ -431,33 +964,46 @@ func (fInfo *FileInfo) compareInfo(info *os.FileInfo) bool {
 
 // Создание информации в буфере из файла
 func (buf *BufInfo) buildInfo(name, path string, file *os.FileInfo) {
-	(*buf).mu.Lock()
-	defer (*buf).mu.Unlock()
 	fullPath := filepath.Join(path, name)
 	var tmp = []string{path}
-	(*buf).files[name] = &FileInfo{
+	fInfo := &FileInfo{
 		From:    fullPath,
 		Where:   tmp,
 		Mode:    (*file).Mode(),
 		Size:    (*file).Size(),
 		ModTime: (*file).ModTime(),
 		IsDir:   (*file).IsDir(),
+		IsLink:  isLink(*file),
+		Seen:    make(map[string]Version),
 	}
-	buf.setTime()
-}
+	if (*fInfo).IsLink {
+		(*fInfo).Link, _ = buf.fsys().Readlink(fullPath)
+	}
+	// Метаданные читаются до блокировки буфера
+	buf.readMeta(fullPath, *file, fInfo)
 
-// Создание массива имён файлов
-func MakePathArr(path string) (*[]string, error) {
-	var tmp = &[]string{}
-	err := filepath.Walk(path, func(str string, _ os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if str == path {
-			return nil
+	(*buf).mu.Lock()
+	defer (*buf).mu.Unlock()
+	// Версии файла в остальных директориях сохраняются для поиска конфликтов
+	old, ok := (*buf).files[name]
+	if ok {
+		for wherePath, ver := range (*old).Seen {
+			(*fInfo).Seen[wherePath] = ver
 		}
-		name, _ := filepath.Rel(path, str)
+	}
+	if !ok || (*old).IsDir != (*fInfo).IsDir {
+		(*buf).names++
+	}
+	(*fInfo).Seen[path] = fInfo.version()
+	(*buf).files[name] = fInfo
+	buf.setTime(name)
+}
 
+// Создание массива имён файлов без исключённых файлов
+// с учётом способа обработки ссылок
+func MakePathArr(fsys FS, path string, ig *Ignore, mode LinkMode) (*[]string, error) {
+	var tmp = &[]string{}
+	err := walkPath(fsys, path, ig, mode, func(name string, _ os.FileInfo) error {
 		*tmp = append(*tmp, name)
 
 		return nil
@@ -468,49 +1014,125 @@ func MakePathArr(path string) (*[]string, error) {
 	return tmp, nil
 }
 
-// Создание массива имён файлов
-func (buf *BufInfo) comparePathInfo(path string) (bool, error) {
+// Файл директории с информацией, полученной при обходе
+type pathEntry struct {
+	name string
+	info os.FileInfo
+}
+
+// Обход директории без исключённых файлов. Буфер при обходе не блокируется
+func (buf *BufInfo) scanPath(path string, ig *Ignore) ([]pathEntry, error) {
+	var entries []pathEntry
+	err := walkPath(buf.fsys(), path, ig, (*buf).opts.Links, func(name string, info os.FileInfo) error {
+		entries = append(entries, pathEntry{name: name, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Проверка наличия изменений в файлах директории по сравнению с буфером.
+// Под блокировкой буфера сравниваются только полученные при обходе данные,
+// а ссылки и непрочитанные расширенные атрибуты проверяются после её снятия
+func (buf *BufInfo) comparePathInfo(path string, entries []pathEntry, ig *Ignore) bool {
+	total := buf.countNames(path, ig)
+
 	(*buf).mu.RLock()
-	defer (*buf).mu.RUnlock()
-	check := false
-	pathLen := 0
-	err := filepath.Walk(path, func(str string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if str == path {
-			return nil
+	present := 0
+	var slow []pathEntry
+	for _, entry := range entries {
+		name, info := entry.name, entry.info
+		fInfo, ok := (*buf).files[name]
+		if !ok {
+			(*buf).mu.RUnlock()
+			return true
 		}
-		pathLen++
-		name, _ := filepath.Rel(path, str)
+		present++
 
-		if _, ok := (*buf).files[name]; !ok {
-			check = true
-			return nil
+		// Размер директории зависит от файловой системы
+		changed := !info.IsDir() && info.Size() != (*fInfo).Size ||
+			!info.ModTime().Equal((*fInfo).ModTime) ||
+			info.Mode().Type() != (*fInfo).Mode.Type() ||
+			info.Mode()&modeBits != (*fInfo).Mode&modeBits ||
+			(*fInfo).IsLink != isLink(info) ||
+			buf.ownerChanged(info, fInfo)
+		if !changed && (*buf).opts.Hash && info.Mode().IsRegular() {
+			changed = buf.hashStale(filepath.Join(path, name), info, (*fInfo).Hash)
+		}
+		if changed {
+			(*buf).mu.RUnlock()
+			return true
 		}
 
-		if info.Size() != (*buf).files[name].Size {
-			check = true
-			return nil
+		if (*fInfo).IsLink {
+			slow = append(slow, entry)
+			continue
 		}
-		if !info.IsDir() && !info.ModTime().Equal((*buf).files[name].ModTime) {
-			check = true
-			return err
+		if !(*buf).opts.syncXattrs() {
+			continue
 		}
-		if info.Mode() != (*buf).files[name].Mode {
-			check = true
-			return nil
+		if attrs, ok := buf.cachedXattrs(filepath.Join(path, name), info); ok {
+			if !maps.EqualFunc(attrs, (*fInfo).Xattrs, bytes.Equal) {
+				(*buf).mu.RUnlock()
+				return true
+			}
+			continue
 		}
+		slow = append(slow, entry)
+	}
+	(*buf).mu.RUnlock()
+	if present != total {
+		return true
+	}
 
-		return nil
-	})
-	if err != nil {
-		return check, err
+	for _, entry := range slow {
+		fullPath := filepath.Join(path, entry.name)
+		fInfo := buf.TakeFileInfo(entry.name)
+		if fInfo == nil || !buf.sameLink(fullPath, entry.info, fInfo) ||
+			buf.metaChanged(fullPath, entry.info, fInfo) {
+			return true
+		}
 	}
-	if pathLen != len((*buf).files) {
-		check = true
+	return false
+}
+
+// Количество файлов буфера, учтённое при заданном наборе имён и исключениях
+type nameCount struct {
+	names uint64
+	rules string
+	count int
+}
+
+// Получение количества файлов в буфере, не исключённых в директории.
+// Пока набор имён в буфере и исключения не меняются, используется
+// посчитанное в прошлом цикле значение
+func (buf *BufInfo) countNames(path string, ig *Ignore) int {
+	rules := ig.String()
+	(*buf).mu.RLock()
+	names := (*buf).names
+	state := (*buf).roots[path]
+	if state != nil && state.count != nil &&
+		state.count.names == names && state.count.rules == rules {
+		count := state.count.count
+		(*buf).mu.RUnlock()
+		return count
+	}
+	count := 0
+	for name, fInfo := range (*buf).files {
+		if !ig.Match(name, (*fInfo).IsDir) {
+			count++
+		}
 	}
-	return check, nil
+	(*buf).mu.RUnlock()
+
+	if state != nil {
+		(*buf).mu.Lock()
+		state.count = &nameCount{names: names, rules: rules, count: count}
+		(*buf).mu.Unlock()
+	}
+	return count
 }
 
 // Сравнение времени изменения буфера и синхронизируемой директории
@@ -527,9 +1149,20 @@ func (buf *BufInfo) updateTime(tm *time.Time) {
 	*tm = (*buf).updTime
 }
 
-// Фиксирование времени изменения буфера
-func (buf *BufInfo) setTime() {
+// Фиксирование времени изменения буфера, запись имени изменённого
+// файла в журнал и оповещение ожидающих синхронизации директорий
+func (buf *BufInfo) setTime(name string) {
 	(*buf).updTime = time.Now()
+	buf.addJournal(name)
+	close((*buf).updated)
+	(*buf).updated = make(chan struct{})
+}
+
+// Получение канала, который закрывается при изменении буфера
+func (buf *BufInfo) updatedChan() <-chan struct{} {
+	(*buf).mu.RLock()
+	defer (*buf).mu.RUnlock()
+	return (*buf).updated
 }
 
 // Поиск наличия информации о файле в буфере
@@ -545,8 +1178,15 @@ func (buf *BufInfo) findInfo(name string) bool {
 // Инициализация структуры BufInfo
 func InitBufInfo() *BufInfo {
 	var buf = &BufInfo{
-		files: make(map[string]*FileInfo),
-		tomb:  make(map[string]struct{}),
+		files:    make(map[string]*FileInfo),
+		tomb:     make(map[string]struct{}),
+		hashes:   make(map[string]hashInfo),
+		metas:    make(map[string]metaInfo),
+		updated:  make(chan struct{}),
+		inodes:   make(map[string]map[fileID]string),
+		roots:    make(map[string]*rootState),
+		failures: make(map[string]*Failure),
+		settling: make(map[string]*settleInfo),
 	}
 	return buf
 }
@@ -558,7 +1198,15 @@ func (buf *BufInfo) TakeFileInfo(name string) *FileInfo {
 	if _, ok := (*buf).files[name]; !ok {
 		return nil
 	}
-	tmp := (*(*buf).files[name])
+	return (*buf).files[name].clone()
+}
+
+// Копирование информации о файле вместе со списками директорий
+func (fInfo *FileInfo) clone() *FileInfo {
+	tmp := *fInfo
+	tmp.Where = slices.Clone((*fInfo).Where)
+	tmp.Seen = maps.Clone((*fInfo).Seen)
+	tmp.Xattrs = maps.Clone((*fInfo).Xattrs)
 	return &tmp
 }
 
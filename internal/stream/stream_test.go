@@ -0,0 +1,1513 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Создание синхронизируемых директорий с одинаковыми файлами
+// в файловой системе fsys
+func makeRoots(t *testing.T, fsys FS, n int) []string {
+	t.Helper()
+	base := t.TempDir()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var paths []string
+	for i := 0; i < n; i++ {
+		path := filepath.Join(base, "root"+string(rune('1'+i)))
+		require.NoError(t, fsys.MkdirAll(path, 0755))
+		writeFile(t, fsys, filepath.Join(path, "text.txt"), []byte("some text"), 0644, modTime)
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Запись файла с заданными правами и временем изменения в файловой системе fsys
+func writeFile(t *testing.T, fsys FS, name string, data []byte, perm fs.FileMode, modTime time.Time) {
+	t.Helper()
+	require.NoError(t, writeAtomic(fsys, name, perm, modTime, func(file File) error {
+		_, err := file.Write(data)
+		return err
+	}))
+}
+
+func TestStateOfflineDelete(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	stateName := filepath.Join(t.TempDir(), "state.json")
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SaveState(stateName))
+
+	// Файл удалён, пока программа не работала
+	req.NoError(os.Remove(filepath.Join(paths[0], "text.txt")))
+
+	buf, err = LoadState(stateName, paths, Options{})
+	req.NoError(err)
+	req.Equal(1, buf.FilesLen())
+
+	var tm1, tm2 time.Time
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoFileExists(filepath.Join(paths[0], "text.txt"))
+	req.NoFileExists(filepath.Join(paths[1], "text.txt"))
+}
+
+func TestStateKeepPaths(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	stateName := filepath.Join(t.TempDir(), "state.json")
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	var tm1, tm2 time.Time
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SaveState(stateName))
+
+	// Состояние другого набора директорий не загружается
+	_, err = LoadState(stateName, paths[1:], Options{})
+	req.ErrorIs(err, ErrStateDirs)
+	buf, err = LoadState(stateName, []string{paths[1], paths[0]}, Options{})
+	req.NoError(err)
+	req.Equal(1, buf.FilesLen())
+
+	// Из состояния без списка директорий удаляются лишние директории
+	data, err := os.ReadFile(stateName)
+	req.NoError(err)
+	var state map[string]json.RawMessage
+	req.NoError(json.Unmarshal(data, &state))
+	delete(state, "paths")
+	data, err = json.Marshal(state)
+	req.NoError(err)
+	req.NoError(os.WriteFile(stateName, data, 0644))
+
+	buf, err = LoadState(stateName, paths[1:], Options{})
+	req.NoError(err)
+	fInf := buf.TakeFileInfo("text.txt")
+	req.NotNil(fInf)
+	req.Equal([]string{paths[1]}, fInf.Where)
+	req.Equal(filepath.Join(paths[1], "text.txt"), fInf.From)
+}
+
+func TestHashTouchWithoutCopy(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	buf, err := SyncInfo(paths, Options{Hash: true})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	name1 := filepath.Join(paths[0], "text.txt")
+	name2 := filepath.Join(paths[1], "text.txt")
+	before, err := os.Stat(name2)
+	req.NoError(err)
+
+	newTime := time.Now().Truncate(time.Second)
+	req.NoError(os.Chtimes(name1, newTime, newTime))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	after, err := os.Stat(name2)
+	req.NoError(err)
+	req.True(os.SameFile(before, after))
+	req.True(after.ModTime().Equal(newTime))
+}
+
+func TestHashRestoredModTime(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	buf, err := SyncInfo(paths, Options{Hash: true})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	// Изменение содержимого того же размера с восстановлением времени
+	name1 := filepath.Join(paths[0], "text.txt")
+	info, err := os.Stat(name1)
+	req.NoError(err)
+	req.NoError(os.WriteFile(name1, []byte("same size"), 0644))
+	req.NoError(os.Chtimes(name1, info.ModTime(), info.ModTime()))
+
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	data, err := os.ReadFile(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal("same size", string(data))
+}
+
+// Изменение text.txt в двух директориях
+func editBoth(t *testing.T, fsys FS, paths []string) {
+	t.Helper()
+	for i, text := range []string{"first edit", "second edit"} {
+		modTime := time.Now().Add(time.Duration(i-2) * time.Minute)
+		writeFile(t, fsys, filepath.Join(paths[i], "text.txt"), []byte(text), 0644, modTime)
+	}
+}
+
+func TestConflictNewest(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	buf, err := SyncInfo(paths, Options{Conflict: ConflictNewest})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	editBoth(t, LocalFS{}, paths)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(path, "text.txt"))
+		req.NoError(err)
+		req.Equal("second edit", string(data))
+	}
+}
+
+func TestConflictKeepBoth(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	buf, err := SyncInfo(paths, Options{Conflict: ConflictKeepBoth})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	editBoth(t, LocalFS{}, paths)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(path, "text.txt"))
+		req.NoError(err)
+		req.Equal("first edit", string(data))
+
+		copies, err := filepath.Glob(filepath.Join(path, "text.txt.conflict-root2-*"))
+		req.NoError(err)
+		req.Len(copies, 1)
+		data, err = os.ReadFile(copies[0])
+		req.NoError(err)
+		req.Equal("second edit", string(data))
+	}
+}
+
+// Ожидание события об изменении файла с заданным именем
+func waitEvent(t *testing.T, watch *Watcher, name string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-watch.Events:
+			if event == name {
+				return
+			}
+		case err := <-watch.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no event for ", name)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	req := require.New(t)
+	root := t.TempDir()
+
+	watch, err := NewWatcher(root, nil)
+	if err != nil {
+		t.Skip("inotify is not available: ", err)
+	}
+	defer watch.Close()
+
+	req.NoError(os.MkdirAll(filepath.Join(root, "dir1", "dir2"), 0755))
+	waitEvent(t, watch, filepath.Join("dir1", "dir2"))
+
+	name := filepath.Join("dir1", "dir2", "text.txt")
+	req.NoError(os.WriteFile(filepath.Join(root, name), []byte("text"), 0644))
+	waitEvent(t, watch, name)
+
+	req.NoError(os.Remove(filepath.Join(root, name)))
+	waitEvent(t, watch, name)
+}
+
+func TestIgnoreMatch(t *testing.T) {
+	req := require.New(t)
+	ig := ParseIgnore([]string{
+		"# comment",
+		"*.swp",
+		"node_modules/",
+		"/build",
+		"docs/**/*.tmp",
+		"!keep.swp",
+	})
+
+	req.True(ig.Match("a.swp", false))
+	req.True(ig.Match(filepath.Join("dir", "b.swp"), false))
+	req.False(ig.Match("keep.swp", false))
+	req.True(ig.Match("node_modules", true))
+	req.False(ig.Match("node_modules", false))
+	req.True(ig.Match(filepath.Join("src", "node_modules", "x.js"), false))
+	req.True(ig.Match("build", true))
+	req.False(ig.Match(filepath.Join("src", "build"), true))
+	req.True(ig.Match(filepath.Join("docs", "a", "b", "c.tmp"), false))
+	req.True(ig.Match(filepath.Join("docs", "c.tmp"), false))
+	req.False(ig.Match("c.tmp", false))
+}
+
+func TestIgnoreSync(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	req.NoError(os.WriteFile(filepath.Join(paths[0], IgnoreFile), []byte("*.log\n"), 0644))
+	req.NoError(os.WriteFile(filepath.Join(paths[0], "a.log"), []byte("log"), 0644))
+	req.NoError(os.WriteFile(filepath.Join(paths[0], "a.tmp"), []byte("tmp"), 0644))
+	req.NoError(os.WriteFile(filepath.Join(paths[1], "b.log"), []byte("log"), 0644))
+
+	buf, err := SyncInfo(paths, Options{Ignore: []string{"*.tmp"}})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+
+	// Файл исключён в первой директории, поэтому не копируется в неё и не удаляется из второй
+	req.NoFileExists(filepath.Join(paths[1], "a.log"))
+	req.NoFileExists(filepath.Join(paths[1], "a.tmp"))
+	req.NoFileExists(filepath.Join(paths[1], IgnoreFile))
+	req.NoFileExists(filepath.Join(paths[0], "b.log"))
+	req.FileExists(filepath.Join(paths[1], "b.log"))
+	req.FileExists(filepath.Join(paths[0], "a.tmp"))
+}
+
+func TestBuildFileAtomic(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	tmpName := filepath.Join(paths[1], TmpPrefix+"123")
+	req.NoError(os.WriteFile(tmpName, []byte("partial"), 0644))
+	req.NoError(CleanTemp(LocalFS{}, paths[1]))
+	req.NoFileExists(tmpName)
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	name1 := filepath.Join(paths[0], "text.txt")
+	req.NoError(os.WriteFile(name1, []byte("new text"), 0600))
+	req.NoError(os.Chmod(name1, 0600))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	info, err := os.Stat(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal(os.FileMode(0600), info.Mode().Perm())
+	entries, err := os.ReadDir(paths[1])
+	req.NoError(err)
+	req.Len(entries, 1)
+}
+
+func TestCopyFile(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	data := make([]byte, 3*copyBufSize+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	srcName := filepath.Join(dir, "src")
+	req.NoError(os.WriteFile(srcName, data, 0644))
+
+	for name, copyFunc := range map[string]func(dst, src *os.File, ctx context.Context) error{
+		"kernel": copyFile,
+		"buffer": func(dst, src *os.File, ctx context.Context) error {
+			return copyBuffer(dst, src, ctx)
+		},
+	} {
+		src, err := os.Open(srcName)
+		req.NoError(err)
+		dst, err := os.Create(filepath.Join(dir, name))
+		req.NoError(err)
+		req.NoError(copyFunc(dst, src, context.Background()))
+		src.Close()
+		dst.Close()
+
+		copied, err := os.ReadFile(filepath.Join(dir, name))
+		req.NoError(err)
+		req.Equal(data, copied, name)
+	}
+
+	// Отменённый контекст прерывает копирование
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src, err := os.Open(srcName)
+	req.NoError(err)
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, "canceled"))
+	req.NoError(err)
+	defer dst.Close()
+	req.ErrorIs(copyFile(dst, src, ctx), context.Canceled)
+}
+
+// Синхронизация двух директорий, в первой из которых есть ссылки
+func syncLinks(t *testing.T, mode LinkMode) []string {
+	t.Helper()
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+
+	req.NoError(os.Mkdir(filepath.Join(paths[0], "dir"), 0755))
+	req.NoError(os.Symlink("text.txt", filepath.Join(paths[0], "link.txt")))
+	// Ссылка на родительскую директорию образует цикл
+	req.NoError(os.Symlink("..", filepath.Join(paths[0], "dir", "loop")))
+
+	buf, err := SyncInfo(paths, Options{Links: mode})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	return paths
+}
+
+func TestLinksPreserve(t *testing.T) {
+	req := require.New(t)
+	paths := syncLinks(t, LinkPreserve)
+
+	target, err := os.Readlink(filepath.Join(paths[1], "link.txt"))
+	req.NoError(err)
+	req.Equal("text.txt", target)
+	target, err = os.Readlink(filepath.Join(paths[1], "dir", "loop"))
+	req.NoError(err)
+	req.Equal("..", target)
+}
+
+func TestLinksFollow(t *testing.T) {
+	req := require.New(t)
+	paths := syncLinks(t, LinkFollow)
+
+	info, err := os.Lstat(filepath.Join(paths[1], "link.txt"))
+	req.NoError(err)
+	req.True(info.Mode().IsRegular())
+	req.NoFileExists(filepath.Join(paths[1], "dir", "loop"))
+	req.NoDirExists(filepath.Join(paths[1], "dir", "loop"))
+}
+
+func TestLinksSkip(t *testing.T) {
+	req := require.New(t)
+	paths := syncLinks(t, LinkSkip)
+
+	_, err := os.Lstat(filepath.Join(paths[1], "link.txt"))
+	req.ErrorIs(err, os.ErrNotExist)
+	req.DirExists(filepath.Join(paths[1], "dir"))
+	_, err = os.Lstat(filepath.Join(paths[0], "link.txt"))
+	req.NoError(err)
+}
+
+// Синхронизация, переименование в первой директории и повторная синхронизация.
+// Возвращает информацию о файле во второй директории до переименования
+func syncMove(t *testing.T, move func(root string)) (os.FileInfo, []string) {
+	t.Helper()
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+
+	req.NoError(os.MkdirAll(filepath.Join(paths[0], "old"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(paths[0], "old", "big.bin"), []byte("big data"), 0644))
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+
+	before, err := os.Stat(filepath.Join(paths[1], "old", "big.bin"))
+	req.NoError(err)
+
+	move(paths[0])
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	return before, paths
+}
+
+func TestMoveByInode(t *testing.T) {
+	req := require.New(t)
+	before, paths := syncMove(t, func(root string) {
+		req.NoError(os.Rename(filepath.Join(root, "old"), filepath.Join(root, "new")))
+	})
+
+	after, err := os.Stat(filepath.Join(paths[1], "new", "big.bin"))
+	req.NoError(err)
+	req.True(os.SameFile(before, after))
+	req.NoDirExists(filepath.Join(paths[1], "old"))
+}
+
+func TestMoveByHash(t *testing.T) {
+	req := require.New(t)
+	before, paths := syncMove(t, func(root string) {
+		oldName := filepath.Join(root, "old", "big.bin")
+		data, err := os.ReadFile(oldName)
+		req.NoError(err)
+		req.NoError(os.WriteFile(filepath.Join(root, "moved.bin"), data, 0644))
+		req.NoError(os.Remove(oldName))
+	})
+
+	after, err := os.Stat(filepath.Join(paths[1], "moved.bin"))
+	req.NoError(err)
+	req.True(os.SameFile(before, after))
+	req.NoFileExists(filepath.Join(paths[1], "old", "big.bin"))
+}
+
+func TestVersions(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+
+	buf, err := SyncInfo(paths, Options{Versions: true, KeepVersions: 1})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	// Перезаписанный файл сохраняется как версия
+	req.NoError(os.WriteFile(filepath.Join(paths[0], "text.txt"), []byte("new text"), 0644))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	vers, err := ListVersions(LocalFS{}, paths[1], "text.txt")
+	req.NoError(err)
+	req.Len(vers, 1)
+	data, err := os.ReadFile(vers[0].Path)
+	req.NoError(err)
+	req.Equal("some text", string(data))
+
+	// Удалённый файл переносится в версии, старая версия удаляется
+	req.NoError(os.Remove(filepath.Join(paths[0], "text.txt")))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoFileExists(filepath.Join(paths[1], "text.txt"))
+
+	vers, err = ListVersions(LocalFS{}, paths[1], "text.txt")
+	req.NoError(err)
+	req.Len(vers, 1)
+	data, err = os.ReadFile(vers[0].Path)
+	req.NoError(err)
+	req.Equal("new text", string(data))
+
+	_, err = RestoreVersion(LocalFS{}, paths[1], "text.txt", vers[0].Stamp(), ctx)
+	req.NoError(err)
+	data, err = os.ReadFile(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal("new text", string(data))
+}
+
+func TestMassDeleteGuard(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		name := filepath.Join(paths[0], "file"+strconv.Itoa(i))
+		req.NoError(os.WriteFile(name, []byte("data"), 0644))
+	}
+	buf, err := SyncInfo(paths, Options{MaxDeletePercent: DefaultMaxDeletePercent})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.FileExists(filepath.Join(paths[1], "file0"))
+
+	// Удаление больше половины файлов приостанавливает синхронизацию
+	for i := 0; i < 15; i++ {
+		req.NoError(os.Remove(filepath.Join(paths[0], "file"+strconv.Itoa(i))))
+	}
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.FileExists(filepath.Join(paths[1], "file0"))
+	req.NoFileExists(filepath.Join(paths[0], "file0"))
+	req.True(buf.NeedConfirm(paths[0]))
+	req.Contains(buf.Paused(paths[0]), "mass deletion of 15 of")
+	req.NotContains(buf.Paused(paths[0]), "confirm")
+	// Ожидание подтверждения не считается ошибкой директории
+	req.NoError(buf.rootError(paths[0]))
+
+	// После подтверждения удаление распространяется
+	req.NoError(Confirm(LocalFS{}, paths[0]))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoFileExists(filepath.Join(paths[1], "file0"))
+	req.FileExists(filepath.Join(paths[1], "file19"))
+	req.NoFileExists(filepath.Join(paths[0], ConfirmFile))
+	req.False(buf.NeedConfirm(paths[0]))
+}
+
+func TestReplacedRoot(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	// Пропавшая директория не приводит к удалению файлов
+	req.NoError(os.Rename(paths[0], paths[0]+".old"))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.FileExists(filepath.Join(paths[1], "text.txt"))
+
+	// Директория заменена другой, нужна проверка пользователем
+	req.NoError(os.Mkdir(paths[0], 0755))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.FileExists(filepath.Join(paths[1], "text.txt"))
+	req.NoFileExists(filepath.Join(paths[0], "text.txt"))
+
+	req.NoError(Confirm(LocalFS{}, paths[0]))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoFileExists(filepath.Join(paths[1], "text.txt"))
+}
+
+func TestMetaOnly(t *testing.T) {
+	req := require.New(t)
+	paths := makeRoots(t, LocalFS{}, 2)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	req.NoError(os.Mkdir(filepath.Join(paths[0], "dir"), 0755))
+
+	buf, err := SyncInfo(paths, Options{})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	before, err := os.Stat(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+
+	// Изменение прав файла и директории применяется без копирования
+	req.NoError(os.Chmod(filepath.Join(paths[0], "text.txt"), 0600))
+	req.NoError(os.Chmod(filepath.Join(paths[0], "dir"), 0700))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	after, err := os.Stat(filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal(os.FileMode(0600), after.Mode().Perm())
+	req.True(os.SameFile(before, after))
+	info, err := os.Stat(filepath.Join(paths[1], "dir"))
+	req.NoError(err)
+	req.Equal(os.FileMode(0700), info.Mode().Perm())
+
+	// Время изменения директории совпадает после копирования вложенных файлов
+	req.NoError(os.WriteFile(filepath.Join(paths[0], "dir", "new.txt"), []byte("new"), 0644))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.FileExists(filepath.Join(paths[1], "dir", "new.txt"))
+	dir1, err := os.Stat(filepath.Join(paths[0], "dir"))
+	req.NoError(err)
+	dir2, err := os.Stat(filepath.Join(paths[1], "dir"))
+	req.NoError(err)
+	req.True(dir1.ModTime().Equal(dir2.ModTime()))
+
+	// Повторная синхронизация ничего не меняет
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.True(tm1.Equal(tm2))
+
+	// Время директории, переведённое назад, тоже распространяется
+	past := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	req.NoError(os.Chtimes(filepath.Join(paths[1], "dir"), past, past))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	for _, path := range paths {
+		info, err := os.Stat(filepath.Join(path, "dir"))
+		req.NoError(err)
+		req.True(past.Equal(info.ModTime()), path)
+	}
+}
+
+// Создание имён файлов, распределённых по директориям
+func makeNames(n int) []string {
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		names = append(names, filepath.Join("dir"+strconv.Itoa(i%100), "file"+strconv.Itoa(i)))
+	}
+	return names
+}
+
+func BenchmarkSyncFiles(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			base := b.TempDir()
+			modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+			paths := []string{filepath.Join(base, "root1"), filepath.Join(base, "root2")}
+			for _, path := range paths {
+				for i := 0; i < 100; i++ {
+					require.NoError(b, os.MkdirAll(filepath.Join(path, "dir"+strconv.Itoa(i)), 0755))
+				}
+				for _, name := range makeNames(n) {
+					fullPath := filepath.Join(path, name)
+					require.NoError(b, os.WriteFile(fullPath, []byte("data"), 0644))
+					require.NoError(b, os.Chtimes(fullPath, modTime, modTime))
+				}
+			}
+
+			buf, err := SyncInfo(paths, Options{})
+			require.NoError(b, err)
+			ctx := context.Background()
+			var tm time.Time
+			require.NoError(b, buf.SyncFiles(paths[0], &tm, ctx))
+			require.NoError(b, buf.SyncFiles(paths[1], &tm, ctx))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Полный цикл без пропуска по времени обновления буфера
+				var tm time.Time
+				require.NoError(b, buf.SyncFiles(paths[0], &tm, ctx))
+			}
+		})
+	}
+}
+
+// Цикл синхронизации директории с миллионом файлов в памяти:
+// проверка без изменений и полный цикл без пропуска по времени обновления буфера
+func BenchmarkSyncFilesMem(b *testing.B) {
+	const n = 1000000
+	mem := NewMemFS()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	paths := []string{"/root1", "/root2"}
+	names := makeNames(n)
+	for _, path := range paths {
+		for i := 0; i < 100; i++ {
+			require.NoError(b, mem.MkdirAll(filepath.Join(path, "dir"+strconv.Itoa(i)), 0755))
+		}
+		for _, name := range names {
+			fullPath := filepath.Join(path, name)
+			require.NoError(b, mem.WriteFile(fullPath, []byte("data"), 0644))
+			require.NoError(b, mem.Chtimes(fullPath, modTime, modTime))
+		}
+		for i := 0; i < 100; i++ {
+			require.NoError(b, mem.Chtimes(filepath.Join(path, "dir"+strconv.Itoa(i)), modTime, modTime))
+		}
+	}
+
+	buf, err := SyncInfo(paths, Options{FS: mem})
+	require.NoError(b, err)
+	ctx := context.Background()
+	var tm1, tm2 time.Time
+	require.NoError(b, buf.SyncFiles(paths[0], &tm1, ctx))
+	require.NoError(b, buf.SyncFiles(paths[1], &tm2, ctx))
+	require.NoError(b, buf.SyncFiles(paths[0], &tm1, ctx))
+
+	b.Run("idle", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, buf.SyncFiles(paths[0], &tm1, ctx))
+		}
+	})
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var tm time.Time
+			require.NoError(b, buf.SyncFiles(paths[0], &tm, ctx))
+		}
+	})
+}
+
+func TestMemFS(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := []string{"/root1", "/root2"}
+	for _, path := range paths {
+		req.NoError(mem.MkdirAll(path, 0755))
+	}
+	req.NoError(mem.MkdirAll("/root1/dir", 0755))
+	req.NoError(mem.WriteFile("/root1/dir/text.txt", []byte("some text"), 0644))
+	req.NoError(mem.Symlink("dir/text.txt", "/root1/link"))
+
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	buf, err := SyncInfo(paths, Options{FS: mem})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+
+	data, err := fsReadAll(mem, "/root2/dir/text.txt")
+	req.NoError(err)
+	req.Equal("some text", string(data))
+	target, err := mem.Readlink("/root2/link")
+	req.NoError(err)
+	req.Equal("dir/text.txt", target)
+
+	// Переименование определяется по хешу и повторяется без копирования
+	req.NoError(mem.Rename("/root1/dir/text.txt", "/root1/dir/moved.txt"))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	_, err = mem.Lstat("/root2/dir/text.txt")
+	req.ErrorIs(err, fs.ErrNotExist)
+	data, err = fsReadAll(mem, "/root2/dir/moved.txt")
+	req.NoError(err)
+	req.Equal("some text", string(data))
+
+	req.NoError(mem.RemoveAll("/root2/dir"))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	_, err = mem.Lstat("/root1/dir")
+	req.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestSyncNames(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := []string{"/root1", "/root2"}
+	for _, path := range paths {
+		req.NoError(mem.MkdirAll(filepath.Join(path, "dir"), 0755))
+	}
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	buf, err := SyncInfo(paths, Options{FS: mem})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	_, pos, _ := buf.journalSince(0)
+
+	// Синхронизируются только файлы из событий
+	req.NoError(mem.WriteFile("/root1/dir/new.txt", []byte("new"), 0644))
+	req.NoError(mem.WriteFile("/root1/other.txt", []byte("other"), 0644))
+	req.NoError(buf.SyncNames(paths[0], []string{"dir/new.txt"}, nil, &tm1, ctx))
+
+	// Другая директория получает изменённые в буфере файлы из журнала
+	names, pos, ok := buf.journalSince(pos)
+	req.True(ok)
+	req.Contains(names, "dir/new.txt")
+	req.NoError(buf.SyncNames(paths[1], nil, names, &tm2, ctx))
+	data, err := fsReadAll(mem, "/root2/dir/new.txt")
+	req.NoError(err)
+	req.Equal("new", string(data))
+	_, err = mem.Lstat("/root2/other.txt")
+	req.ErrorIs(err, fs.ErrNotExist)
+
+	// Удаление директории удаляет из буфера всё её поддерево
+	req.NoError(mem.RemoveAll("/root1/dir"))
+	req.NoError(buf.SyncNames(paths[0], []string{"dir"}, nil, &tm1, ctx))
+	names, _, ok = buf.journalSince(pos)
+	req.True(ok)
+	req.NoError(buf.SyncNames(paths[1], nil, names, &tm2, ctx))
+	_, err = mem.Lstat("/root2/dir")
+	req.ErrorIs(err, fs.ErrNotExist)
+
+	// Отставшая от журнала директория синхронизируется полным обходом
+	buf.mu.Lock()
+	for i := 0; i <= maxJournal; i++ {
+		buf.addJournal("other.txt")
+	}
+	buf.mu.Unlock()
+	_, _, ok = buf.journalSince(pos)
+	req.False(ok)
+}
+
+// Чтение файла из файловой системы целиком
+func fsReadAll(fsys FS, name string) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func TestPeerSync(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 1)
+	remote := NewMemFS()
+	remotePaths := makeRoots(t, remote, 1)
+	req.NoError(remote.MkdirAll(filepath.Join(remotePaths[0], "dir"), 0755))
+	req.NoError(remote.WriteFile(filepath.Join(remotePaths[0], "dir", "remote.txt"), []byte("remote"), 0644))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ln, remote, map[string]string{"remote": remotePaths[0]}, "secret", ctx)
+	}()
+	defer func() {
+		cancel()
+		req.NoError(<-done)
+	}()
+
+	addr, name, path, err := ParsePeer(PeerScheme + ln.Addr().String() + "/remote")
+	req.NoError(err)
+	// Клиент с другим ключом не получает доступа
+	_, err = NewPeerFS(addr, name, path, "wrong").Stat(path)
+	req.ErrorIs(err, fs.ErrPermission)
+	// Слишком большой запрос подтверждения отклоняется без проверки ключа
+	_, err = NewPeerFS(addr, name, path, strings.Repeat("secret", maxPeerAuth)).Stat(path)
+	req.Error(err)
+	req.NotErrorIs(err, fs.ErrPermission)
+
+	fsys := NewMountFS(mem)
+	fsys.Mount(path, NewPeerFS(addr, name, path, "secret"))
+	roots := []string{paths[0], path}
+	var tm1, tm2 time.Time
+	buf, err := SyncInfo(roots, Options{FS: fsys})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(roots[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(roots[1], &tm2, ctx))
+
+	data, err := fsReadAll(mem, filepath.Join(paths[0], "dir", "remote.txt"))
+	req.NoError(err)
+	req.Equal("remote", string(data))
+
+	// Изменение на локальной стороне отправляется на сервер блоками
+	big := make([]byte, 3*peerBlockSize+5)
+	for i := range big {
+		big[i] = byte(i % 253)
+	}
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "big.bin"), big, 0600))
+	req.NoError(mem.Remove(filepath.Join(paths[0], "text.txt")))
+	req.NoError(buf.SyncFiles(roots[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(roots[1], &tm2, ctx))
+
+	data, err = fsReadAll(remote, filepath.Join(remotePaths[0], "big.bin"))
+	req.NoError(err)
+	req.Equal(big, data)
+	info, err := remote.Stat(filepath.Join(remotePaths[0], "big.bin"))
+	req.NoError(err)
+	req.Equal(os.FileMode(0600), info.Mode().Perm())
+	_, err = remote.Lstat(filepath.Join(remotePaths[0], "text.txt"))
+	req.ErrorIs(err, fs.ErrNotExist)
+
+	// Изменённый файл отправляется разницей, сигнатура вычисляется на сервере
+	big[peerBlockSize] ^= 0xff
+	big = slices.Insert(big, 10, []byte("inserted")...)
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "big.bin"), big, 0600))
+	modTime := time.Now().Add(time.Minute)
+	req.NoError(mem.Chtimes(filepath.Join(paths[0], "big.bin"), modTime, modTime))
+	req.NoError(buf.SyncFiles(roots[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(roots[1], &tm2, ctx))
+
+	data, err = fsReadAll(remote, filepath.Join(remotePaths[0], "big.bin"))
+	req.NoError(err)
+	req.Equal(big, data)
+
+	// Подтверждение и сброс ошибок записываются в удалённую директорию
+	req.NoError(Confirm(fsys, path))
+	req.NoError(ClearFailures(fsys, path, []string{"big.bin"}))
+	data, err = fsReadAll(remote, filepath.Join(remotePaths[0], RetryFile))
+	req.NoError(err)
+	req.Equal("big.bin\n", string(data))
+	_, err = remote.Stat(filepath.Join(remotePaths[0], ConfirmFile))
+	req.NoError(err)
+}
+
+func TestPeerTimeout(t *testing.T) {
+	req := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	defer ln.Close()
+
+	// Сервер подтверждает доступ и перестаёт отвечать
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var auth peerAuthRequest
+				if gob.NewDecoder(conn).Decode(&auth) != nil {
+					return
+				}
+				if gob.NewEncoder(conn).Encode(&peerResponse{}) != nil {
+					return
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	addr, name, path, err := ParsePeer(PeerScheme + ln.Addr().String() + "/remote")
+	req.NoError(err)
+	pfs := NewPeerFS(addr, name, path, "secret")
+	pfs.timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = pfs.Stat(path)
+	req.ErrorIs(err, os.ErrDeadlineExceeded)
+	req.Less(time.Since(start), peerTimeout)
+
+	// Недоступная удалённая директория приостанавливается
+	buf := InitBufInfo()
+	(*buf).opts.FS = pfs
+	req.False(buf.checkRoot(path))
+	req.NotEmpty(buf.Paused(path))
+}
+
+func TestPeerPath(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 1)
+	root := paths[0]
+	req.NoError(mem.MkdirAll(filepath.Join(root, "dir"), 0755))
+	req.NoError(mem.Symlink("/", filepath.Join(root, "x")))
+	req.NoError(mem.Symlink("dir", filepath.Join(root, "y")))
+	req.NoError(mem.Symlink("../..", filepath.Join(root, "dir", "up")))
+
+	name, err := peerPath(mem, root, "y/new.txt", true)
+	req.NoError(err)
+	req.Equal(filepath.Join(root, "dir", "new.txt"), name)
+	name, err = peerPath(mem, root, "../../text.txt", true)
+	req.NoError(err)
+	req.Equal(filepath.Join(root, "text.txt"), name)
+
+	// Сама ссылка доступна, а переход по ней за пределы директории - нет
+	name, err = peerPath(mem, root, "x", false)
+	req.NoError(err)
+	req.Equal(filepath.Join(root, "x"), name)
+	for _, name := range []string{"x", "x/etc/passwd", "y/up/etc"} {
+		_, err = peerPath(mem, root, name, true)
+		req.ErrorIs(err, fs.ErrPermission, name)
+	}
+
+	resp := handlePeer(&peerRequest{Op: "stat", Root: "root", Name: "x/root1"}, mem, map[string]string{"root": root}, nil)
+	req.Equal(peerErrPermission, resp.Code)
+	resp = handlePeer(&peerRequest{Op: "read", Root: "root", Name: "y/../x/root1/text.txt"}, mem, map[string]string{"root": root}, nil)
+	req.Equal(peerErrPermission, resp.Code)
+}
+
+func TestPeerDelta(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 1)
+	data := make([]byte, 3*peerBlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "image.bin"), data, 0644))
+	roots := map[string]string{"root": paths[0]}
+
+	// Сигнатура передаётся только с первой частью разницы
+	blockSize := deltaBlockSize(int64(len(data)))
+	sums, err := fileSignature(bytes.NewReader(make([]byte, len(data))), blockSize)
+	req.NoError(err)
+	deltas := make(map[uint64][]BlockSum)
+	delta := peerRequest{Op: "delta", Root: "root", Name: "image.bin", Size: blockSize, Delta: 1, Sums: sums}
+	var out []byte
+	for pages := 0; ; pages++ {
+		resp := handlePeer(&delta, mem, roots, deltas)
+		req.Zero(resp.Code, resp.Err)
+		for _, op := range resp.Ops {
+			out = append(out, op.Data...)
+		}
+		if resp.EOF {
+			req.Greater(pages, 1)
+			break
+		}
+		req.Contains(deltas, uint64(1))
+		delta.Sums = nil
+		delta.Offset = int64(len(out))
+	}
+	req.Equal(data, out)
+	req.Empty(deltas)
+
+	// Без сохранённой сигнатуры часть разницы не вычисляется
+	resp := handlePeer(&delta, mem, roots, deltas)
+	req.Equal(peerErrInvalid, resp.Code)
+}
+
+func TestDelta(t *testing.T) {
+	req := require.New(t)
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 3<<20+123)
+	rnd.Read(old)
+
+	// Изменение байта, вставка и удаление в разных местах файла
+	data := slices.Clone(old)
+	data[1<<20] ^= 0xff
+	data = slices.Insert(data, 100, []byte("inserted")...)
+	data = slices.Delete(data, 2<<20, 2<<20+500)
+
+	blockSize := deltaBlockSize(int64(len(old)))
+	sums, err := fileSignature(bytes.NewReader(old), blockSize)
+	req.NoError(err)
+	var out []byte
+	var literal int
+	err = scanDelta(bytes.NewReader(data), sums, blockSize, 0, func(op DeltaOp) error {
+		req.Equal(int64(len(out)), op.Offset)
+		if len(op.Data) > 0 {
+			literal += len(op.Data)
+			out = append(out, op.Data...)
+			return nil
+		}
+		from := op.Block * int64(blockSize)
+		out = append(out, old[from:from+int64(blockSize)]...)
+		return nil
+	})
+	req.NoError(err)
+	req.Equal(data, out)
+	req.Less(literal, 4*blockSize+len(old)%blockSize)
+
+	// Синхронизация изменённого файла через разницу с копией в другой директории.
+	// На локальном диске копия создаётся клонированием средствами ядра
+	for _, fsys := range []FS{LocalFS{}, NewMemFS()} {
+		paths := makeRoots(t, fsys, 2)
+		var tm1, tm2 time.Time
+		modTime := time.Now().Add(-time.Minute)
+		writeFile(t, fsys, filepath.Join(paths[0], "image.bin"), old, 0644, modTime)
+		buf, err := SyncInfo(paths, Options{FS: fsys})
+		req.NoError(err)
+		req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+		req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+		writeFile(t, fsys, filepath.Join(paths[0], "image.bin"), data, 0640, time.Now())
+		req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+		req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+		got, err := fsReadAll(fsys, filepath.Join(paths[1], "image.bin"))
+		req.NoError(err)
+		req.Equal(data, got)
+		info, err := fsys.Stat(filepath.Join(paths[1], "image.bin"))
+		req.NoError(err)
+		req.Equal(os.FileMode(0640), info.Mode().Perm())
+		entries, err := fsys.ReadDir(paths[1])
+		req.NoError(err)
+		req.Len(entries, 2)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 2)
+	var tm1, tm2 time.Time
+	buf, err := SyncInfo(paths, Options{FS: mem})
+	req.NoError(err)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+
+	big := make([]byte, deltaMinSize)
+	req.NoError(mem.WriteFile(filepath.Join(paths[1], "big.bin"), big, 0644))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, context.Background()))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, context.Background()))
+
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "new.txt"), []byte("new"), 0644))
+	req.NoError(mem.Remove(filepath.Join(paths[1], "text.txt")))
+	// Перезапись большого файла передавалась бы разницей
+	big[0] = 1
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "big.bin"), big, 0644))
+	modTime := time.Now().Add(time.Minute)
+	req.NoError(mem.Chtimes(filepath.Join(paths[0], "big.bin"), modTime, modTime))
+
+	plans, err := buf.Plan(paths, context.Background())
+	req.NoError(err)
+	req.Equal([]RootPlan{
+		{Path: paths[0], Actions: []PlanAction{{Op: PlanDelete, Name: "text.txt"}}},
+		{Path: paths[1], Actions: []PlanAction{
+			{Op: PlanOverwrite, Name: "big.bin"},
+			{Op: PlanCreate, Name: "new.txt"},
+		}},
+	}, plans)
+
+	// Файлы и буфер не изменились, поэтому план можно вычислить снова
+	_, err = mem.Stat(filepath.Join(paths[0], "text.txt"))
+	req.NoError(err)
+	_, err = mem.Stat(filepath.Join(paths[1], "new.txt"))
+	req.ErrorIs(err, fs.ErrNotExist)
+	data, err := fsReadAll(mem, filepath.Join(paths[1], "big.bin"))
+	req.NoError(err)
+	req.Zero(data[0])
+	again, err := buf.Plan(paths, context.Background())
+	req.NoError(err)
+	req.Equal(plans, again)
+
+	// Файл, который существует только в плане, читается пустым
+	pfs := NewPlanFS(mem)
+	file, err := pfs.CreateTemp(paths[1], TmpPrefix+"*")
+	req.NoError(err)
+	req.NoError(pfs.Rename(file.Name(), filepath.Join(paths[1], "new.txt")))
+	for _, name := range []string{file.Name(), filepath.Join(paths[1], "new.txt")} {
+		data, err = fsReadAll(pfs, name)
+		req.NoError(err)
+		req.Empty(data)
+	}
+	data, err = fsReadAll(pfs, filepath.Join(paths[0], "new.txt"))
+	req.NoError(err)
+	req.Equal("new", string(data))
+}
+
+func TestSyncOnce(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 3)
+	buf, err := SyncInfo(paths, Options{FS: mem})
+	req.NoError(err)
+	req.NoError(buf.SyncOnce(paths, context.Background()))
+	req.Equal(Stats{}, buf.Stats())
+
+	// Файлы из последней директории доходят до первой за один запуск
+	req.NoError(mem.WriteFile(filepath.Join(paths[2], "last.txt"), []byte("last"), 0644))
+	editBoth(t, mem, paths[1:])
+	req.NoError(buf.SyncOnce(paths, context.Background()))
+	for _, path := range paths {
+		data, err := fsReadAll(mem, filepath.Join(path, "last.txt"))
+		req.NoError(err)
+		req.Equal("last", string(data))
+		data, err = fsReadAll(mem, filepath.Join(path, "text.txt"))
+		req.NoError(err)
+		req.Equal("second edit", string(data))
+	}
+
+	stats := buf.Stats()
+	req.Equal(int64(4), stats.Copied)
+	req.Equal(int64(2*len("last")+2*len("second edit")), stats.Bytes)
+	req.Equal(int64(1), stats.Conflicts)
+	req.Zero(stats.Errors)
+	for _, path := range paths {
+		req.Empty(buf.Paused(path))
+	}
+
+	// Файлы, которые меняются на каждом проходе, не дают закончить синхронизацию
+	buf, err = SyncInfo(paths, Options{FS: &churnFS{MemFS: mem, dir: paths[2]}})
+	req.NoError(err)
+	req.ErrorIs(buf.SyncOnce(paths, context.Background()), ErrNotSettled)
+}
+
+func TestSyncOnceSettle(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 2)
+	settle := 200 * time.Millisecond
+	buf, err := SyncInfo(paths, Options{FS: mem, Settle: settle})
+	req.NoError(err)
+	req.NoError(buf.SyncOnce(paths, context.Background()))
+
+	// Только что изменённые файлы копируются, когда будут записаны
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "text.txt"), []byte("some text and more"), 0644))
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "new.txt"), []byte("new"), 0644))
+	req.NoError(buf.SyncOnce(paths, context.Background()))
+	data, err := fsReadAll(mem, filepath.Join(paths[1], "text.txt"))
+	req.NoError(err)
+	req.Equal("some text and more", string(data))
+	data, err = fsReadAll(mem, filepath.Join(paths[1], "new.txt"))
+	req.NoError(err)
+	req.Equal("new", string(data))
+	req.Equal(int64(2), buf.Stats().Copied)
+
+	// Файл, который записывается дольше всех проходов, не даёт закончить синхронизацию
+	buf, err = SyncInfo(paths, Options{FS: &churnFS{MemFS: mem, dir: paths[1]}, Settle: settle})
+	req.NoError(err)
+	req.ErrorIs(buf.SyncOnce(paths, context.Background()), ErrNotSettled)
+}
+
+// Файловая система, в которой файл директории dir меняется при каждом её чтении
+type churnFS struct {
+	*MemFS
+	dir string
+	n   int
+}
+
+func (fsys *churnFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == fsys.dir {
+		fsys.n++
+		fullPath := filepath.Join(name, "churn.txt")
+		modTime := time.Now().Add(time.Duration(fsys.n) * time.Minute)
+		if err := fsys.MemFS.WriteFile(fullPath, []byte(strconv.Itoa(fsys.n)), 0644); err != nil {
+			return nil, err
+		}
+		if err := fsys.MemFS.Chtimes(fullPath, modTime, modTime); err != nil {
+			return nil, err
+		}
+	}
+	return fsys.MemFS.ReadDir(name)
+}
+
+func TestRunSyncRecovery(t *testing.T) {
+	req := require.New(t)
+	req.Equal(20*time.Millisecond, retryDelay(10*time.Millisecond, 1))
+	req.Equal(80*time.Millisecond, retryDelay(10*time.Millisecond, 3))
+	req.Equal(maxRetryDelay, retryDelay(10*time.Millisecond, 100))
+
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 2)
+	buf, err := SyncInfo(paths, Options{FS: mem, Poll: true})
+	req.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	for _, path := range paths {
+		go func() {
+			buf.RunSync(path, 10, ctx)
+			done <- struct{}{}
+		}()
+	}
+	defer func() {
+		cancel()
+		<-done
+		<-done
+	}()
+
+	// Пропавшая директория переходит в деградированное состояние,
+	// остальные директории продолжают синхронизироваться
+	away := paths[1] + ".away"
+	req.NoError(mem.Rename(paths[1], away))
+	req.Eventually(func() bool { return buf.rootError(paths[1]) != nil },
+		5*time.Second, 10*time.Millisecond)
+	req.NoError(mem.WriteFile(filepath.Join(paths[0], "new.txt"), []byte("new"), 0644))
+	req.Eventually(func() bool { return buf.TakeFileInfo("new.txt") != nil },
+		5*time.Second, 10*time.Millisecond)
+
+	// После возвращения директория синхронизируется снова
+	req.NoError(mem.Rename(away, paths[1]))
+	req.Eventually(func() bool {
+		_, err := mem.Stat(filepath.Join(paths[1], "new.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	req.NoError(buf.rootError(paths[1]))
+}
+
+// Файловая система, в которой нельзя создавать файлы в директории dir
+type failFS struct {
+	*MemFS
+	dir  string
+	fail bool
+}
+
+func (fsys *failFS) CreateTemp(dir, pattern string) (File, error) {
+	if fsys.fail && dir == fsys.dir {
+		return nil, fs.ErrPermission
+	}
+	return fsys.MemFS.CreateTemp(dir, pattern)
+}
+
+func TestFileFailures(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := []string{"/root1", "/root2"}
+	for _, path := range paths {
+		req.NoError(mem.MkdirAll(path, 0755))
+	}
+	fsys := &failFS{MemFS: mem, dir: "/root2", fail: true}
+	buf, err := SyncInfo(paths, Options{FS: fsys, MaxAttempts: 3})
+	req.NoError(err)
+
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+	req.NoError(mem.WriteFile("/root1/new.txt", []byte("new"), 0644))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	failures := buf.Failures()
+	req.Len(failures, 1)
+	req.Equal("/root2", failures[0].Path)
+	req.Equal("new.txt", failures[0].Name)
+	req.Equal("build", failures[0].Op)
+	req.Equal(1, failures[0].Attempts)
+	req.True(failures[0].Next.After(failures[0].Last))
+
+	// До окончания задержки операция не повторяется
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.Equal(1, buf.Failures()[0].Attempts)
+
+	// После MaxAttempts попыток файл помещается в карантин
+	for attempt := 2; attempt <= 4; attempt++ {
+		buf.failures[failureKey("/root2", "new.txt")].Next = time.Time{}
+		req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+		req.Equal(min(attempt, 3), buf.Failures()[0].Attempts)
+	}
+	req.True(buf.Failures()[0].Quarantined)
+	req.Equal(int64(3), buf.Stats().Errors)
+
+	// Ошибки сохраняются вместе с состоянием
+	state := filepath.Join(t.TempDir(), "state.json")
+	req.NoError(buf.SaveState(state))
+	saved, err := LoadFailures(state)
+	req.NoError(err)
+	req.Equal(buf.Failures()[0].Attempts, saved[0].Attempts)
+	req.True(saved[0].Quarantined)
+
+	// После сброса ошибки файл копируется снова
+	fsys.fail = false
+	req.NoError(mem.WriteFile(filepath.Join("/root2", RetryFile), nil, 0644))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.Empty(buf.Failures())
+	data, err := fsReadAll(mem, "/root2/new.txt")
+	req.NoError(err)
+	req.Equal("new", string(data))
+	_, err = mem.Lstat(filepath.Join("/root2", RetryFile))
+	req.ErrorIs(err, fs.ErrNotExist)
+
+	// Запись в директорию после ошибки откладывается,
+	// но изменения файла в самой директории попадают в буфер
+	fsys.fail = true
+	modTime := time.Now().Add(time.Minute)
+	req.NoError(mem.WriteFile("/root1/new.txt", []byte("from first"), 0644))
+	req.NoError(mem.Chtimes("/root1/new.txt", modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.Len(buf.Failures(), 1)
+	modTime = modTime.Add(time.Minute)
+	req.NoError(mem.WriteFile("/root2/new.txt", []byte("from second"), 0644))
+	req.NoError(mem.Chtimes("/root2/new.txt", modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	data, err = fsReadAll(mem, "/root1/new.txt")
+	req.NoError(err)
+	req.Equal("from second", string(data))
+}
+
+func TestCheckRoots(t *testing.T) {
+	req := require.New(t)
+	base := t.TempDir()
+	dir1, dir2 := filepath.Join(base, "dir1"), filepath.Join(base, "dir2")
+	nested := filepath.Join(dir1, "sub")
+	req.NoError(os.MkdirAll(nested, 0755))
+	req.NoError(os.Mkdir(dir2, 0755))
+	link := filepath.Join(base, "link")
+	req.NoError(os.Symlink(dir1, link))
+
+	req.NoError(CheckRoots([]string{dir1, dir2, "peer://host:7070/docs"}))
+
+	var overlap *OverlapError
+	err := CheckRoots([]string{dir1, dir2, dir1 + "/"})
+	req.ErrorAs(err, &overlap)
+	req.False(overlap.Nested)
+
+	err = CheckRoots([]string{nested, dir2, dir1})
+	req.ErrorAs(err, &overlap)
+	req.True(overlap.Nested)
+	req.Equal(nested, overlap.Path)
+	req.Equal(dir1, overlap.Other)
+
+	// Символическая ссылка на другую директорию
+	err = CheckRoots([]string{dir1, link})
+	req.ErrorAs(err, &overlap)
+	req.Equal(link, overlap.Path)
+	req.ErrorContains(err, "same directory")
+}
+
+func TestSettle(t *testing.T) {
+	req := require.New(t)
+	mem := NewMemFS()
+	paths := makeRoots(t, mem, 2)
+	settle := 200 * time.Millisecond
+	buf, err := SyncInfo(paths, Options{FS: mem, Settle: settle})
+	req.NoError(err)
+	var tm1, tm2 time.Time
+	ctx := context.Background()
+
+	// Файл, который ещё записывается, не копируется
+	name1 := filepath.Join(paths[0], "new.txt")
+	name2 := filepath.Join(paths[1], "new.txt")
+	req.NoError(mem.WriteFile(name1, []byte("part"), 0644))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.Nil(buf.TakeFileInfo("new.txt"))
+	delay := buf.pendingDelay(paths[0])
+	req.Greater(delay, time.Duration(0))
+	req.LessOrEqual(delay, settle)
+
+	time.Sleep(delay)
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NotNil(buf.TakeFileInfo("new.txt"))
+	req.Zero(buf.pendingDelay(paths[0]))
+
+	// Исходный файл изменился после обхода: копия откладывается без ошибки
+	modTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	req.NoError(mem.WriteFile(name1, []byte("part and rest"), 0644))
+	req.NoError(mem.Chtimes(name1, modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	_, err = mem.Stat(name2)
+	req.ErrorIs(err, fs.ErrNotExist)
+	req.Empty(buf.Failures())
+	req.Zero(buf.Stats().Errors)
+
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	data, err := fsReadAll(mem, name2)
+	req.NoError(err)
+	req.Equal("part and rest", string(data))
+
+	// Изменение без изменения размера также откладывает копию
+	modTime = modTime.Add(time.Second)
+	req.NoError(mem.WriteFile(name1, []byte("PART AND REST"), 0644))
+	req.NoError(mem.Chtimes(name1, modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	modTime = modTime.Add(time.Second)
+	req.NoError(mem.WriteFile(name1, []byte("part AND rest"), 0644))
+	req.NoError(mem.Chtimes(name1, modTime, modTime))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	data, err = fsReadAll(mem, name2)
+	req.NoError(err)
+	req.Equal("part and rest", string(data))
+	req.Empty(buf.Failures())
+
+	// Исходный файл изменился во время чтения: копия не заменяет файл
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	(*buf).opts.FS = &editFS{MemFS: mem, name: name1}
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	data, err = fsReadAll(mem, name2)
+	req.NoError(err)
+	req.Equal("part and rest", string(data))
+	req.Empty(buf.Failures())
+	req.Zero(buf.Stats().Errors)
+
+	(*buf).opts.FS = mem
+	req.NoError(buf.SyncFiles(paths[0], &tm1, ctx))
+	req.NoError(buf.SyncFiles(paths[1], &tm2, ctx))
+	data, err = fsReadAll(mem, name2)
+	req.NoError(err)
+	req.Equal("part AND rest", string(data))
+}
+
+// Файловая система, в которой файл name меняется при открытии для чтения
+type editFS struct {
+	*MemFS
+	name string
+}
+
+func (fsys *editFS) Open(name string) (io.ReadCloser, error) {
+	file, err := fsys.MemFS.Open(name)
+	if err != nil || name != fsys.name {
+		return file, err
+	}
+	info, err := fsys.MemFS.Stat(name)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	modTime := info.ModTime().Add(time.Second)
+	if err := fsys.MemFS.Chtimes(name, modTime, modTime); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,288 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Директория в корне синхронизируемой директории, в которой хранятся
+// удалённые и перезаписанные версии файлов
+const VersionsDir = ".sync_versions"
+
+// Формат времени в имени версии файла
+const versionTimeFormat = "20060102-150405.000000000"
+
+// Сохранённая версия файла
+type VersionFile struct {
+	// Имя файла относительно директории
+	Name string
+	// Полный путь к версии
+	Path string
+	// Время удаления или перезаписи файла
+	Time time.Time
+	Size int64
+}
+
+// Получение метки версии для команды восстановления
+func (ver VersionFile) Stamp() string {
+	return ver.Time.Format(versionTimeFormat)
+}
+
+// Путь к версии файла
+func versionPath(path, name string, tm time.Time) string {
+	return filepath.Join(path, VersionsDir, name+"~"+tm.Format(versionTimeFormat))
+}
+
+// Удаление файла из директории. Если хранение версий включено,
+// файл переносится в директорию версий
+func (buf *BufInfo) removeFile(path, name string) error {
+	fullPath := filepath.Join(path, name)
+	buf.dropHash(fullPath)
+	buf.touchDir(path, name)
+	fsys := buf.fsys()
+	if !(*buf).opts.Versions {
+		return fsys.RemoveAll(fullPath)
+	}
+
+	// Пустые директории не сохраняются
+	if entries, err := fsys.ReadDir(fullPath); err == nil && len(entries) == 0 {
+		return fsys.Remove(fullPath)
+	}
+
+	verPath := versionPath(path, name, time.Now())
+	err := fsys.MkdirAll(filepath.Dir(verPath), 0755)
+	if err != nil {
+		return err
+	}
+	err = fsys.Rename(fullPath, verPath)
+	if err != nil {
+		return err
+	}
+	return buf.pruneName(path, name)
+}
+
+// Сохранение версии файла перед его перезаписью
+func (buf *BufInfo) keepVersion(path, name string, info os.FileInfo, ctx context.Context) error {
+	if !(*buf).opts.Versions {
+		return nil
+	}
+	err := saveVersion(buf.fsys(), path, name, info, ctx)
+	if err != nil {
+		return err
+	}
+	return buf.pruneName(path, name)
+}
+
+// Сохранение версии файла, который остаётся на месте.
+// Версия создаётся жёсткой ссылкой, а если это невозможно - копированием
+func saveVersion(fsys FS, path, name string, info os.FileInfo, ctx context.Context) error {
+	if !info.Mode().IsRegular() && !isLink(info) {
+		return nil
+	}
+	fullPath := filepath.Join(path, name)
+	verPath := versionPath(path, name, time.Now())
+	err := fsys.MkdirAll(filepath.Dir(verPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = errors.ErrUnsupported
+	if lfs, ok := fsys.(LinkFS); ok {
+		err = lfs.Link(fullPath, verPath)
+	}
+	if err != nil && info.Mode().IsRegular() {
+		src, err := fsys.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		return writeAtomic(fsys, verPath, info.Mode(), info.ModTime(),
+			func(file File) error {
+				return copyData(file, src, ctx)
+			})
+	}
+	return err
+}
+
+// Удаление лишних версий файла согласно настройкам хранения
+func (buf *BufInfo) pruneName(path, name string) error {
+	vers, err := ListVersions(buf.fsys(), path, name)
+	if err != nil {
+		return err
+	}
+	return pruneVersions(buf.fsys(), vers, (*buf).opts.KeepVersions, (*buf).opts.KeepDays)
+}
+
+// Удаление версий сверх заданного количества и старше заданного числа дней.
+// Версии должны быть отсортированы от новых к старым
+func pruneVersions(fsys FS, vers []VersionFile, keep, days int) error {
+	border := time.Now().AddDate(0, 0, -days)
+	for i, ver := range vers {
+		if (keep <= 0 || i < keep) && (days <= 0 || ver.Time.After(border)) {
+			continue
+		}
+		err := fsys.RemoveAll(ver.Path)
+		if err != nil {
+			return err
+		}
+		slog.Info("Version removed",
+			"File", ver.Name,
+			"Version", ver.Stamp())
+	}
+	return nil
+}
+
+// Разбор имени версии на имя файла и время
+func parseVersion(path, verName string) (VersionFile, bool) {
+	i := strings.LastIndex(verName, "~")
+	if i < 0 {
+		return VersionFile{}, false
+	}
+	tm, err := time.ParseInLocation(versionTimeFormat, verName[i+1:], time.Local)
+	if err != nil {
+		return VersionFile{}, false
+	}
+	return VersionFile{
+		Name: verName[:i],
+		Path: filepath.Join(path, VersionsDir, verName),
+		Time: tm,
+	}, true
+}
+
+// Получение версий файла, отсортированных от новых к старым
+func ListVersions(fsys FS, path, name string) ([]VersionFile, error) {
+	dir := filepath.Join(path, VersionsDir, filepath.Dir(name))
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var vers []VersionFile
+	for _, entry := range entries {
+		verName := filepath.Join(filepath.Dir(name), entry.Name())
+		ver, ok := parseVersion(path, verName)
+		if !ok || ver.Name != filepath.Clean(name) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			ver.Size = info.Size()
+		}
+		vers = append(vers, ver)
+	}
+	sortVersions(vers)
+	return vers, nil
+}
+
+// Сортировка версий от новых к старым
+func sortVersions(vers []VersionFile) {
+	slices.SortFunc(vers, func(a, b VersionFile) int {
+		return b.Time.Compare(a.Time)
+	})
+}
+
+// Удаление лишних версий всех файлов директории
+func PruneVersions(fsys FS, path string, keep, days int) error {
+	if keep <= 0 && days <= 0 {
+		return nil
+	}
+	byName := make(map[string][]VersionFile)
+	err := findVersions(fsys, path, "", byName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, vers := range byName {
+		sortVersions(vers)
+		err := pruneVersions(fsys, vers, keep, days)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Рекурсивный поиск версий в поддиректории rel директории версий
+func findVersions(fsys FS, path, rel string, byName map[string][]VersionFile) error {
+	entries, err := fsys.ReadDir(filepath.Join(path, VersionsDir, rel))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		verName := filepath.Join(rel, entry.Name())
+		if ver, ok := parseVersion(path, verName); ok {
+			byName[ver.Name] = append(byName[ver.Name], ver)
+			continue
+		}
+		if entry.IsDir() {
+			err := findVersions(fsys, path, verName, byName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Восстановление версии файла. Если метка версии не задана,
+// восстанавливается последняя версия. Текущий файл сохраняется как версия
+func RestoreVersion(fsys FS, path, name, stamp string, ctx context.Context) (VersionFile, error) {
+	vers, err := ListVersions(fsys, path, name)
+	if err != nil {
+		return VersionFile{}, err
+	}
+	idx := 0
+	if stamp != "" {
+		idx = slices.IndexFunc(vers, func(ver VersionFile) bool {
+			return ver.Stamp() == stamp
+		})
+	}
+	if idx < 0 || len(vers) == 0 {
+		return VersionFile{}, fmt.Errorf("version of %s not found", name)
+	}
+	ver := vers[idx]
+
+	info, err := fsys.Lstat(ver.Path)
+	if err != nil {
+		return ver, err
+	}
+	if !info.Mode().IsRegular() {
+		return ver, fmt.Errorf("version %s is not a regular file", ver.Stamp())
+	}
+
+	fullPath := filepath.Join(path, name)
+	if cur, err := fsys.Lstat(fullPath); err == nil {
+		err = saveVersion(fsys, path, name, cur, ctx)
+		if err != nil {
+			return ver, err
+		}
+	}
+
+	err = fsys.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return ver, err
+	}
+	src, err := fsys.Open(ver.Path)
+	if err != nil {
+		return ver, err
+	}
+	defer src.Close()
+	err = writeAtomic(fsys, fullPath, info.Mode(), info.ModTime(),
+		func(file File) error {
+			return copyData(file, src, ctx)
+		})
+	return ver, err
+}
@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Обход директории без исключённых файлов с учётом способа обработки ссылок.
+// fn получает имя файла относительно директории и информацию о нём
+func walkPath(fsys FS, path string, ig *Ignore, mode LinkMode, fn func(name string, info os.FileInfo) error) error {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return err
+	}
+	return walkDir(fsys, path, "", ig, mode, fn, []os.FileInfo{info})
+}
+
+// Обход файлов, вложенных в поддиректорию rel. Для поиска циклов
+// из ссылок заново собираются директории на пути от корня
+func walkSubdir(fsys FS, path, rel string, ig *Ignore, mode LinkMode, fn func(name string, info os.FileInfo) error) error {
+	var stack []os.FileInfo
+	for dir := rel; ; dir = filepath.Dir(dir) {
+		info, err := fsys.Stat(filepath.Join(path, dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stack = append(stack, info)
+		if dir == "." {
+			break
+		}
+	}
+	slices.Reverse(stack)
+	return walkDir(fsys, path, rel, ig, mode, fn, stack)
+}
+
+// Рекурсивный обход поддиректории. stack содержит директории
+// на пути от корня и используется для поиска циклов из ссылок
+func walkDir(fsys FS, path, rel string, ig *Ignore, mode LinkMode,
+	fn func(name string, info os.FileInfo) error, stack []os.FileInfo) error {
+	entries, err := fsys.ReadDir(filepath.Join(path, rel))
+	if err != nil {
+		// Директория могла быть удалена во время обхода
+		if rel != "" && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(rel, entry.Name())
+		fullPath := filepath.Join(path, name)
+
+		// Информация о файле без перехода по ссылке уже получена при чтении директории
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+
+		if isLink(info) {
+			switch mode {
+			case LinkSkip:
+				continue
+			case LinkFollow:
+				info, err = fsys.Stat(fullPath)
+				if err != nil {
+					slog.Warn("Broken link is skipped",
+						"Path", path,
+						"File", name,
+						"Error", err)
+					continue
+				}
+				if info.IsDir() && inStack(stack, info) {
+					slog.Warn("Link loop is skipped",
+						"Path", path,
+						"File", name)
+					continue
+				}
+			}
+		}
+
+		if ig.matchName(name, info.IsDir()) {
+			continue
+		}
+		err = fn(name, info)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = walkDir(fsys, path, name, ig, mode, fn, append(stack, info))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Проверка, что директория уже есть на пути от корня
+func inStack(stack []os.FileInfo, info os.FileInfo) bool {
+	for _, dir := range stack {
+		if sameFile(dir, info) {
+			return true
+		}
+	}
+	return false
+}
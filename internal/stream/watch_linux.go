@@ -0,0 +1,220 @@
+package stream
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// События inotify, на которые подписываются директории
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// Отслеживание изменений в директории и всех её поддиректориях через inotify
+type Watcher struct {
+	// Имена изменённых файлов относительно директории.
+	// Пустое имя означает, что часть событий потеряна
+	Events chan string
+	// Ошибки, после которых отслеживание невозможно
+	Errors chan error
+
+	root  string
+	ig    *Ignore
+	file  *os.File
+	fd    int
+	dirs  map[int]string
+	mu    sync.Mutex
+	done  chan struct{}
+	close sync.Once
+}
+
+// Создание наблюдателя за директорией и всеми её поддиректориями.
+// Исключённые шаблонами ig директории и директория версий не отслеживаются
+func NewWatcher(root string, ig *Ignore) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events: make(chan string, 64),
+		Errors: make(chan error, 1),
+		root:   root,
+		ig:     ig,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		dirs:   make(map[int]string),
+		done:   make(chan struct{}),
+	}
+
+	err = w.addTree(root, nil)
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// Завершение отслеживания
+func (w *Watcher) Close() error {
+	var err error
+	w.close.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
+
+// Добавление наблюдения за директорией и всеми её поддиректориями.
+// Имена найденных файлов передаются в found, так как они могли
+// появиться раньше, чем было установлено наблюдение
+func (w *Watcher) addTree(dir string, found func(name string)) error {
+	return filepath.WalkDir(dir, func(str string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Директория могла быть удалена во время обхода
+			if str != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && str != w.root && w.ignored(str) {
+			return fs.SkipDir
+		}
+		if found != nil && str != dir {
+			found(str)
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, str, watchMask)
+		if err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				return nil
+			}
+			return err
+		}
+		w.mu.Lock()
+		w.dirs[wd] = str
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// Проверка, что директория исключена из синхронизации
+// и наблюдение за ней не нужно
+func (w *Watcher) ignored(fullPath string) bool {
+	name, err := filepath.Rel(w.root, fullPath)
+	if err != nil {
+		return false
+	}
+	return name == VersionsDir || w.ig.Match(name, true)
+}
+
+// Чтение и разбор событий inotify
+func (w *Watcher) readEvents() {
+	defer close(w.Events)
+	var data [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+
+	for {
+		n, err := w.file.Read(data[:])
+		if err != nil {
+			select {
+			case <-w.done:
+			case w.Errors <- err:
+			default:
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&data[offset]))
+			nameLen := int(event.Len)
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + nameLen
+
+			var name string
+			if nameLen > 0 {
+				name = string(data[start:offset])
+				name = name[:clen(name)]
+			}
+			if !w.handleEvent(int(event.Wd), event.Mask, name) {
+				return
+			}
+		}
+	}
+}
+
+// Обработка одного события. Возвращает false, если отслеживание завершено
+func (w *Watcher) handleEvent(wd int, mask uint32, name string) bool {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return w.send("")
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	if dir == w.root && mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		select {
+		case w.Errors <- errors.New("watched directory is removed or moved"):
+		default:
+		}
+		return false
+	}
+	if name == "" {
+		return true
+	}
+
+	fullPath := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 &&
+		mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		err := w.addTree(fullPath, func(str string) {
+			w.send(str)
+		})
+		if err != nil {
+			select {
+			case w.Errors <- err:
+			default:
+			}
+			return false
+		}
+	}
+	return w.send(fullPath)
+}
+
+// Передача имени изменённого файла относительно директории
+func (w *Watcher) send(fullPath string) bool {
+	name := fullPath
+	if fullPath != "" {
+		name, _ = filepath.Rel(w.root, fullPath)
+	}
+	select {
+	case w.Events <- name:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// Длина строки до первого нулевого байта
+func clen(str string) int {
+	for i := 0; i < len(str); i++ {
+		if str[i] == 0 {
+			return i
+		}
+	}
+	return len(str)
+}
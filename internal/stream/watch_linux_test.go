@@ -0,0 +1,45 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcherIgnore(t *testing.T) {
+	req := require.New(t)
+	root := t.TempDir()
+	req.NoError(os.MkdirAll(filepath.Join(root, "node_modules", "pkg"), 0755))
+	req.NoError(os.MkdirAll(filepath.Join(root, VersionsDir, "dir"), 0755))
+	req.NoError(os.MkdirAll(filepath.Join(root, "src"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(root, IgnoreFile), []byte("node_modules/\n"), 0644))
+
+	ig, err := LoadIgnore(LocalFS{}, root, nil)
+	req.NoError(err)
+	watch, err := NewWatcher(root, ig)
+	if err != nil {
+		t.Skip("inotify is not available: ", err)
+	}
+	defer watch.Close()
+
+	var dirs []string
+	watch.mu.Lock()
+	for _, dir := range watch.dirs {
+		dirs = append(dirs, dir)
+	}
+	watch.mu.Unlock()
+	req.ElementsMatch([]string{root, filepath.Join(root, "src")}, dirs)
+
+	// Созданная позже исключённая директория тоже не отслеживается
+	req.NoError(os.MkdirAll(filepath.Join(root, "src", "node_modules"), 0755))
+	waitEvent(t, watch, filepath.Join("src", "node_modules"))
+	name := filepath.Join("src", "text.txt")
+	req.NoError(os.WriteFile(filepath.Join(root, name), []byte("text"), 0644))
+	waitEvent(t, watch, name)
+
+	watch.mu.Lock()
+	req.Len(watch.dirs, 2)
+	watch.mu.Unlock()
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package stream
+
+import "errors"
+
+// Отслеживание изменений в директории. На других системах не поддерживается
+type Watcher struct {
+	Events chan string
+	Errors chan error
+}
+
+// Создание наблюдателя за директорией
+func NewWatcher(root string, ig *Ignore) (*Watcher, error) {
+	return nil, errors.New("inotify is not supported on this system")
+}
+
+// Завершение отслеживания
+func (w *Watcher) Close() error {
+	return nil
+}